@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	dailySparkDays   = 30
+	weeklySparkWeeks = 12
+	busiestDays      = 5
+)
+
+var (
+	sparkLevels   = []rune("▁▂▃▄▅▆▇█")
+	heatmapLevels = []string{"  ", "░░", "▒▒", "▓▓", "██"}
+	weekdayNames  = []string{"Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"}
+)
+
+// directoryScope limits statistics to a directory, and with recursive to its
+// subdirectories too. The zero value matches everything.
+type directoryScope struct {
+	dir       string
+	recursive bool
+}
+
+func directoryScopeFromFlags(cmd *cobra.Command) (directoryScope, error) {
+	dir, _ := cmd.Flags().GetString("dir")
+	recursive, _ := cmd.Flags().GetBool("recursive")
+	if dir == "" {
+		return directoryScope{}, nil
+	}
+	expanded, err := expandHome(dir)
+	if err != nil {
+		return directoryScope{}, err
+	}
+	abs, err := filepath.Abs(expanded)
+	if err != nil {
+		return directoryScope{}, err
+	}
+	return directoryScope{dir: abs, recursive: recursive}, nil
+}
+
+func (s directoryScope) matches(dir string) bool {
+	if s.dir == "" {
+		return true
+	}
+	if s.recursive {
+		return isWithin(dir, s.dir)
+	}
+	return dir == s.dir
+}
+
+// dayCount is the number of runs on one day.
+type dayCount struct {
+	Day   time.Time `json:"day"`
+	Count int       `json:"count"`
+}
+
+// activity summarizes when commands were run.
+type activity struct {
+	Total int `json:"total"`
+	// Heatmap counts runs by weekday (Monday first) and hour of day
+	Heatmap    [7][24]int `json:"heatmap"`
+	Daily      []dayCount `json:"daily"`  // Oldest first, one entry per day including idle ones
+	Weekly     []dayCount `json:"weekly"` // Keyed by the Monday starting each week
+	Busiest    []dayCount `json:"busiest"`
+	ActiveDays int        `json:"active_days"`
+
+	CurrentStreak int       `json:"current_streak"`
+	LongestStreak int       `json:"longest_streak"`
+	LongestEnd    time.Time `json:"longest_end"`
+}
+
+func (app *App) showActivity(cmd *cobra.Command, _ []string) {
+	sinceFlag, _ := cmd.Flags().GetString("since")
+	now := time.Now()
+
+	since, err := parseTimeFlag(sinceFlag, now)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
+	scope, err := directoryScopeFromFlags(cmd)
+	if err != nil {
+		ErrorLogger.Printf("Error resolving directory: %v\n", err)
+		return
+	}
+
+	out, err := rendererFromFlags(cmd)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
+
+	times, err := app.runTimes(since, scope)
+	if err != nil {
+		ErrorLogger.Printf("Error loading runs: %v\n", err)
+		return
+	}
+	a := buildActivity(times, now)
+
+	if !out.text() {
+		if err := out.render(a); err != nil {
+			ErrorLogger.Printf("Error writing output: %v\n", err)
+		}
+		return
+	}
+
+	title := "Activity"
+	if scope.dir != "" {
+		title += " in " + scope.dir
+	}
+	if !since.IsZero() {
+		title += " since " + since.Format("2006-01-02")
+	}
+	fmt.Println(title)
+	fmt.Println(strings.Repeat("=", 40))
+	fmt.Printf("Runs: %d on %d days\n", a.Total, a.ActiveDays)
+	if a.Total == 0 {
+		return
+	}
+
+	fmt.Println("\nBy Hour and Weekday:")
+	printHeatmap(a.Heatmap)
+
+	daily := a.Daily
+	if len(daily) > dailySparkDays {
+		daily = daily[len(daily)-dailySparkDays:]
+	}
+	fmt.Printf("\nDaily (%s to %s, max %d):\n", daily[0].Day.Format("01-02"), daily[len(daily)-1].Day.Format("01-02"), maxCount(daily))
+	fmt.Printf("  %s\n", sparkline(daily))
+
+	weekly := a.Weekly
+	if len(weekly) > weeklySparkWeeks {
+		weekly = weekly[len(weekly)-weeklySparkWeeks:]
+	}
+	fmt.Printf("\nWeekly (from week of %s, max %d):\n", weekly[0].Day.Format("2006-01-02"), maxCount(weekly))
+	fmt.Printf("  %s\n", sparkline(weekly))
+
+	fmt.Println("\nBusiest Days:")
+	for _, d := range a.Busiest {
+		fmt.Printf("  %s %s: %d\n", d.Day.Format("2006-01-02"), d.Day.Format("Mon"), d.Count)
+	}
+
+	fmt.Println("\nStreaks:")
+	fmt.Printf("  Current: %d days\n", a.CurrentStreak)
+	if a.LongestStreak > 0 {
+		start := a.LongestEnd.AddDate(0, 0, -(a.LongestStreak - 1))
+		fmt.Printf("  Longest: %d days (%s to %s)\n", a.LongestStreak, start.Format("2006-01-02"), a.LongestEnd.Format("2006-01-02"))
+	}
+}
+
+// runTimes returns the local time of every run since the given time (zero
+// for all) in scope. Filtering happens here rather than in SQL, since
+// directories may be encrypted and timestamps carry different offsets.
+func (app *App) runTimes(since time.Time, scope directoryScope) ([]time.Time, error) {
+	rows, err := app.db.Query("SELECT timestamp, directory FROM runs")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var times []time.Time
+	for rows.Next() {
+		var t time.Time
+		var dir string
+		if err := rows.Scan(&t, &dir); err != nil {
+			return nil, err
+		}
+		if t.Before(since) || !scope.matches(app.openField(dir)) {
+			continue
+		}
+		times = append(times, t.Local())
+	}
+	return times, rows.Err()
+}
+
+// buildActivity buckets run times by hour, weekday, day and week, and works
+// out the busiest days and streaks of consecutive active days up to now.
+func buildActivity(times []time.Time, now time.Time) activity {
+	var a activity
+	a.Total = len(times)
+	if len(times) == 0 {
+		return a
+	}
+
+	perDay := map[time.Time]int{}
+	first := startOfDay(times[0])
+	for _, t := range times {
+		a.Heatmap[(int(t.Weekday())+6)%7][t.Hour()]++
+		day := startOfDay(t)
+		perDay[day]++
+		if day.Before(first) {
+			first = day
+		}
+	}
+	a.ActiveDays = len(perDay)
+
+	// Runs with clocks ahead of this one still get a day to show
+	today := startOfDay(now)
+	if first.After(today) {
+		first = today
+	}
+	streak := 0
+	for day := first; !day.After(today); day = day.AddDate(0, 0, 1) {
+		count := perDay[day]
+		a.Daily = append(a.Daily, dayCount{Day: day, Count: count})
+
+		monday := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+		if len(a.Weekly) == 0 || !a.Weekly[len(a.Weekly)-1].Day.Equal(monday) {
+			a.Weekly = append(a.Weekly, dayCount{Day: monday})
+		}
+		a.Weekly[len(a.Weekly)-1].Count += count
+
+		if count == 0 {
+			streak = 0
+			continue
+		}
+		streak++
+		if streak > a.LongestStreak {
+			a.LongestStreak, a.LongestEnd = streak, day
+		}
+	}
+
+	// A streak is still current until a whole day passes without commands
+	a.CurrentStreak = streak
+	if perDay[today] == 0 {
+		a.CurrentStreak = 0
+		for day := today.AddDate(0, 0, -1); perDay[day] > 0; day = day.AddDate(0, 0, -1) {
+			a.CurrentStreak++
+		}
+	}
+
+	for day, count := range perDay {
+		a.Busiest = append(a.Busiest, dayCount{Day: day, Count: count})
+	}
+	sort.Slice(a.Busiest, func(i, j int) bool {
+		if a.Busiest[i].Count != a.Busiest[j].Count {
+			return a.Busiest[i].Count > a.Busiest[j].Count
+		}
+		return a.Busiest[i].Day.After(a.Busiest[j].Day)
+	})
+	if len(a.Busiest) > busiestDays {
+		a.Busiest = a.Busiest[:busiestDays]
+	}
+	return a
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func printHeatmap(heatmap [7][24]int) {
+	maxValue := 0
+	for _, hours := range heatmap {
+		for _, n := range hours {
+			maxValue = max(maxValue, n)
+		}
+	}
+
+	var header strings.Builder
+	for hour := 0; hour < 24; hour += 3 {
+		fmt.Fprintf(&header, "%02d    ", hour)
+	}
+	fmt.Printf("      %s\n", strings.TrimSpace(header.String()))
+	for day, hours := range heatmap {
+		var row strings.Builder
+		for _, n := range hours {
+			row.WriteString(heatmapLevels[level(n, maxValue, len(heatmapLevels))])
+		}
+		fmt.Printf("  %s %s\n", weekdayNames[day], row.String())
+	}
+	fmt.Printf("     %s = %d runs\n", heatmapLevels[len(heatmapLevels)-1], maxValue)
+}
+
+// sparkline draws one bar per count, scaled to the largest.
+func sparkline(counts []dayCount) string {
+	maxValue := maxCount(counts)
+	var line strings.Builder
+	for _, c := range counts {
+		if c.Count == 0 {
+			line.WriteRune(' ')
+			continue
+		}
+		line.WriteRune(sparkLevels[level(c.Count, maxValue, len(sparkLevels)+1)-1])
+	}
+	return line.String()
+}
+
+// level maps n in [0, maxValue] to one of levels steps, keeping 0 for zero
+// only.
+func level(n, maxValue, levels int) int {
+	if n <= 0 || maxValue <= 0 {
+		return 0
+	}
+	return 1 + (n*(levels-1)-1)/maxValue
+}
+
+func maxCount(counts []dayCount) int {
+	m := 0
+	for _, c := range counts {
+		m = max(m, c.Count)
+	}
+	return m
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	aliasesFileName = "aliases.sh"
+	// maxPrefixWords is the longest common prefix considered for an alias
+	maxPrefixWords = 4
+	// minAliasSaving is how many keystrokes an alias must save per use before
+	// record points it out
+	minAliasSaving = 3
+)
+
+var (
+	aliasLinePattern = regexp.MustCompile(`^\s*alias\s+([A-Za-z0-9_.:+-]+)=(.*)$`)
+	// functionLinePattern matches the one-line functions suggest writes
+	functionLinePattern = regexp.MustCompile(`^\s*([A-Za-z0-9_.:+-]+)\(\)\s*\{\s*(.*?);?\s*\}\s*$`)
+)
+
+// AliasConfig configures alias suggestions and warnings.
+type AliasConfig struct {
+	// File is where aliases suggest --write appends (default:
+	// ~/.bashtrack/aliases.sh). Aliases in it and in ~/.bash_aliases count as
+	// existing.
+	File string `json:"file,omitempty"`
+	// Warn makes record point out commands an existing alias covers
+	Warn bool `json:"warn"`
+}
+
+// shellAlias is an alias definition read from an aliases file.
+type shellAlias struct {
+	Name      string
+	Expansion string
+}
+
+// aliasSuggestion is a proposed alias or, when the middle of a command
+// varies, a shell function taking that word as $1.
+type aliasSuggestion struct {
+	Function  bool
+	Name      string
+	Expansion string
+	Runs      int
+	Saved     int
+}
+
+// definition returns the shell line defining the suggestion.
+func (s aliasSuggestion) definition() string {
+	if s.Function {
+		return fmt.Sprintf("%s() { %s; }", s.Name, s.Expansion)
+	}
+	return fmt.Sprintf("alias %s=%s", s.Name, shellQuote(s.Expansion))
+}
+
+// aliasCommand is a recorded command split into (decrypted) words.
+type aliasCommand struct {
+	words []string
+	runs  int
+}
+
+func (app *App) aliasesFile() string {
+	if app.config.Aliases.File != "" {
+		return app.config.Aliases.File
+	}
+	configDir, err := getConfigDir()
+	if err != nil {
+		return aliasesFileName
+	}
+	return filepath.Join(configDir, aliasesFileName)
+}
+
+func (app *App) suggestAliases(cmd *cobra.Command, _ []string) {
+	n, _ := cmd.Flags().GetInt("number")
+	minCount, _ := cmd.Flags().GetInt("min-count")
+	minLength, _ := cmd.Flags().GetInt("min-length")
+	write, _ := cmd.Flags().GetBool("write")
+	file, _ := cmd.Flags().GetString("file")
+	if file == "" {
+		file = app.aliasesFile()
+	}
+
+	existing := app.existingAliases()
+	suggestions, err := app.findAliasSuggestions(minCount, minLength, existing)
+	if err != nil {
+		ErrorLogger.Printf("Error analyzing commands: %v\n", err)
+		return
+	}
+	if len(suggestions) > n {
+		suggestions = suggestions[:n]
+	}
+	if len(suggestions) == 0 {
+		fmt.Println("No alias suggestions. Try lowering --min-count or --min-length.")
+		return
+	}
+
+	total := 0
+	for _, s := range suggestions {
+		total += s.Saved
+	}
+	fmt.Printf("Alias suggestions (would have saved ~%d keystrokes):\n", total)
+	fmt.Println(strings.Repeat("-", 80))
+	for _, s := range suggestions {
+		fmt.Printf("%-50s # %d runs, ~%d keystrokes\n", s.definition(), s.Runs, s.Saved)
+	}
+
+	if !write {
+		fmt.Printf("\nRun with --write to add them to %s\n", file)
+		return
+	}
+	written, err := writeAliases(file, suggestions)
+	if err != nil {
+		ErrorLogger.Printf("Error writing aliases: %v\n", err)
+		return
+	}
+	fmt.Printf("\nWrote %d aliases to %s\n", written, file)
+	fmt.Printf("Load them from ~/.bashrc with: source %s\n", file)
+}
+
+func (app *App) setAliasWarnings(_ *cobra.Command, args []string) {
+	if len(args) == 0 {
+		if app.config.Aliases.Warn {
+			fmt.Println("Alias warnings are on")
+		} else {
+			fmt.Println("Alias warnings are off")
+		}
+		return
+	}
+
+	switch args[0] {
+	case "on":
+		app.config.Aliases.Warn = true
+	case "off":
+		app.config.Aliases.Warn = false
+	default:
+		ErrorLogger.Printf("Invalid value '%s': use on or off\n", args[0])
+		return
+	}
+	if err := app.persistConfig(); err != nil {
+		ErrorLogger.Printf("Error saving config: %v\n", err)
+		return
+	}
+	fmt.Printf("Alias warnings turned %s\n", args[0])
+}
+
+// findAliasSuggestions proposes aliases for long commands run at least
+// minCount times, for common prefixes of several commands, and shell
+// functions for commands differing in a single middle word. Expansions an
+// existing alias already covers are skipped. Suggestions are ordered by
+// keystrokes saved.
+func (app *App) findAliasSuggestions(minCount, minLength int, existing []shellAlias) ([]aliasSuggestion, error) {
+	commands, err := app.loadAliasCommands()
+	if err != nil {
+		return nil, err
+	}
+
+	covered := map[string]bool{}
+	for _, a := range existing {
+		covered[a.Expansion] = true
+	}
+
+	var candidates []aliasSuggestion
+	add := func(s aliasSuggestion) {
+		if s.Runs >= minCount && len(s.Expansion) >= minLength && !covered[s.Expansion] {
+			candidates = append(candidates, s)
+		}
+	}
+
+	// Whole commands
+	for _, c := range commands {
+		add(aliasSuggestion{Expansion: strings.Join(c.words, " "), Runs: c.runs})
+	}
+
+	// Common prefixes, used by more than one distinct command. A prefix
+	// that is only ever followed by the same word gives way to the longer one.
+	type prefixUse struct {
+		commands, runs int
+		next           map[string]int
+	}
+	prefixes := map[string]*prefixUse{}
+	for _, c := range commands {
+		for k := 2; k <= maxPrefixWords && k < len(c.words); k++ {
+			prefix := strings.Join(c.words[:k], " ")
+			p, ok := prefixes[prefix]
+			if !ok {
+				p = &prefixUse{next: map[string]int{}}
+				prefixes[prefix] = p
+			}
+			p.commands++
+			p.runs += c.runs
+			p.next[c.words[k]] += c.runs
+		}
+	}
+	for prefix, p := range prefixes {
+		if p.commands < 2 || len(p.next) < 2 {
+			continue
+		}
+		add(aliasSuggestion{Expansion: prefix, Runs: p.runs})
+	}
+
+	// Commands of the same shape with one varying word in the middle
+	functions := map[string][]int{}
+	for _, c := range commands {
+		for i := 1; i < len(c.words)-1; i++ {
+			template := make([]string, len(c.words))
+			copy(template, c.words)
+			template[i] = `"$1"`
+			key := strings.Join(template, " ")
+			functions[key] = append(functions[key], c.runs)
+		}
+	}
+	for template, runs := range functions {
+		if len(runs) < 2 {
+			continue
+		}
+		s := aliasSuggestion{Function: true, Expansion: template}
+		for _, r := range runs {
+			s.Runs += r
+		}
+		add(s)
+	}
+
+	// Name the candidates, most used first so they get the shortest names,
+	// then estimate what each would have saved
+	sort.Slice(candidates, func(i, j int) bool {
+		wi, wj := len(candidates[i].Expansion)*candidates[i].Runs, len(candidates[j].Expansion)*candidates[j].Runs
+		if wi != wj {
+			return wi > wj
+		}
+		return candidates[i].Expansion < candidates[j].Expansion
+	})
+	taken := map[string]bool{}
+	for _, a := range existing {
+		taken[a.Name] = true
+	}
+	var suggestions []aliasSuggestion
+	for _, s := range candidates {
+		s.Name = aliasName(s.Expansion, taken)
+		if s.Function {
+			// Each call still types a space and the argument in place of "$1"
+			s.Saved = (len(s.Expansion) - len(`"$1"`) - len(s.Name) - 1) * s.Runs
+		} else {
+			s.Saved = (len(s.Expansion) - len(s.Name)) * s.Runs
+		}
+		if s.Saved <= 0 {
+			delete(taken, s.Name)
+			continue
+		}
+		suggestions = append(suggestions, s)
+	}
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Saved != suggestions[j].Saved {
+			return suggestions[i].Saved > suggestions[j].Saved
+		}
+		return suggestions[i].Expansion < suggestions[j].Expansion
+	})
+	return suggestions, nil
+}
+
+// loadAliasCommands rebuilds every command from its words by position, so
+// the analysis works on decrypted words either way.
+func (app *App) loadAliasCommands() ([]aliasCommand, error) {
+	rows, err := app.db.Query(`
+		SELECT cwp.command_id, w.word, c.run_count
+		FROM command_word_positions cwp
+		JOIN words w ON w.id = cwp.word_id
+		JOIN commands c ON c.id = cwp.command_id
+		ORDER BY cwp.command_id, cwp.position`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var commands []aliasCommand
+	lastID := -1
+	for rows.Next() {
+		var id, runs int
+		var word string
+		if err := rows.Scan(&id, &word, &runs); err != nil {
+			return nil, err
+		}
+		if id != lastID {
+			commands = append(commands, aliasCommand{runs: runs})
+			lastID = id
+		}
+		c := &commands[len(commands)-1]
+		c.words = append(c.words, app.openField(word))
+	}
+	return commands, rows.Err()
+}
+
+// aliasName derives a short name from the initials of the words ("git
+// status" becomes gs), avoiding names that are taken or are programs on the
+// PATH. The name is marked as taken.
+func aliasName(expansion string, taken map[string]bool) string {
+	var name strings.Builder
+	for _, word := range strings.Fields(expansion) {
+		if word == `"$1"` {
+			continue
+		}
+		for _, r := range strings.ToLower(word) {
+			if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+				name.WriteRune(r)
+				break
+			}
+		}
+	}
+	base := name.String()
+	if len(base) < 2 {
+		base += "x"
+	}
+
+	candidate := base
+	for i := 2; ; i++ {
+		if !taken[candidate] {
+			if _, err := exec.LookPath(candidate); err != nil {
+				break
+			}
+		}
+		candidate = fmt.Sprintf("%s%d", base, i)
+	}
+	taken[candidate] = true
+	return candidate
+}
+
+// shellQuote single-quotes s for the shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// existingAliases reads the aliases defined in the bashtrack aliases file and
+// in ~/.bash_aliases. Missing files are skipped.
+func (app *App) existingAliases() []shellAlias {
+	files := []string{app.aliasesFile()}
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".bash_aliases"))
+	}
+
+	var aliases []shellAlias
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		aliases = append(aliases, parseAliases(f)...)
+		f.Close()
+	}
+	return aliases
+}
+
+func parseAliases(r io.Reader) []shellAlias {
+	var aliases []shellAlias
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := aliasLinePattern.FindStringSubmatch(line); m != nil {
+			aliases = append(aliases, shellAlias{Name: m[1], Expansion: unquoteAlias(m[2])})
+		} else if m := functionLinePattern.FindStringSubmatch(line); m != nil {
+			aliases = append(aliases, shellAlias{Name: m[1], Expansion: m[2]})
+		}
+	}
+	return aliases
+}
+
+// unquoteAlias undoes the quoting of an alias value, ignoring a trailing
+// comment after the closing quote.
+func unquoteAlias(value string) string {
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.HasPrefix(value, "'"):
+		var out strings.Builder
+		rest := value[1:]
+		for {
+			end := strings.Index(rest, "'")
+			if end < 0 {
+				out.WriteString(rest)
+				break
+			}
+			out.WriteString(rest[:end])
+			rest = rest[end+1:]
+			// '\'' continues the string with a literal quote
+			if !strings.HasPrefix(rest, `\''`) {
+				break
+			}
+			out.WriteString("'")
+			rest = rest[3:]
+		}
+		return out.String()
+	case strings.HasPrefix(value, `"`):
+		if end := strings.Index(value[1:], `"`); end >= 0 {
+			return value[1 : end+1]
+		}
+		return value[1:]
+	default:
+		if i := strings.IndexAny(value, " \t#"); i >= 0 {
+			return value[:i]
+		}
+		return value
+	}
+}
+
+// coveringAlias returns the alias whose expansion the command starts with,
+// preferring the longest one, when it would save at least minAliasSaving
+// keystrokes.
+func coveringAlias(command string, aliases []shellAlias) (shellAlias, bool) {
+	var best shellAlias
+	found := false
+	for _, a := range aliases {
+		if a.Expansion == "" || len(a.Expansion)-len(a.Name) < minAliasSaving {
+			continue
+		}
+		if command != a.Expansion && !strings.HasPrefix(command, a.Expansion+" ") {
+			continue
+		}
+		if !found || len(a.Expansion) > len(best.Expansion) {
+			best, found = a, true
+		}
+	}
+	return best, found
+}
+
+// warnCoveredByAlias tells the user when an existing alias would have been
+// shorter. It prints to stdout, since the prompt hook silences stderr.
+func (app *App) warnCoveredByAlias(command string) {
+	if !app.config.Aliases.Warn {
+		return
+	}
+	if a, ok := coveringAlias(command, app.existingAliases()); ok {
+		fmt.Printf("%s: alias %s covers '%s'\n", appName, a.Name, a.Expansion)
+	}
+}
+
+// writeAliases appends the suggestions to file, skipping names it already
+// defines, and returns how many were written.
+func writeAliases(file string, suggestions []aliasSuggestion) (int, error) {
+	defined := map[string]bool{}
+	if f, err := os.Open(file); err == nil {
+		for _, a := range parseAliases(f) {
+			defined[a.Name] = true
+		}
+		f.Close()
+	}
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	written := 0
+	for _, s := range suggestions {
+		if defined[s.Name] {
+			continue
+		}
+		if _, err := fmt.Fprintf(f, "# %d runs, saves ~%d keystrokes\n%s\n", s.Runs, s.Saved, s.definition()); err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// parseCommandID parses a command ID argument and checks that it exists.
+func (app *App) parseCommandID(arg string) (int, error) {
+	id, err := strconv.Atoi(arg)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid command ID %q", arg)
+	}
+	var exists int
+	err = app.db.QueryRow("SELECT 1 FROM commands WHERE id = ?", id).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("no command with ID %d", id)
+	}
+	return id, err
+}
+
+func (app *App) starCommands(cmd *cobra.Command, args []string) {
+	remove, _ := cmd.Flags().GetBool("remove")
+
+	for _, arg := range args {
+		id, err := app.parseCommandID(arg)
+		if err != nil {
+			ErrorLogger.Println(err)
+			continue
+		}
+
+		if remove {
+			_, err = app.db.Exec("DELETE FROM stars WHERE command_id = ?", id)
+		} else {
+			_, err = app.db.Exec("INSERT OR IGNORE INTO stars (command_id, starred_at) VALUES (?, ?)", id, time.Now())
+		}
+		if err != nil {
+			ErrorLogger.Printf("Error updating star for command %d: %v\n", id, err)
+			continue
+		}
+
+		if remove {
+			fmt.Printf("Unstarred command %d\n", id)
+		} else {
+			fmt.Printf("Starred command %d\n", id)
+		}
+	}
+}
+
+func (app *App) tagCommand(cmd *cobra.Command, args []string) {
+	remove, _ := cmd.Flags().GetBool("remove")
+
+	id, err := app.parseCommandID(args[0])
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		ErrorLogger.Printf("Error beginning transaction: %v\n", err)
+		return
+	}
+	defer tx.Rollback() // Safe to call even after commit
+
+	for _, tag := range args[1:] {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if remove {
+			_, err = tx.Exec("DELETE FROM tags WHERE command_id = ? AND tag = ?", id, app.sealField(tag))
+		} else {
+			_, err = tx.Exec("INSERT OR IGNORE INTO tags (command_id, tag) VALUES (?, ?)", id, app.sealField(tag))
+		}
+		if err != nil {
+			ErrorLogger.Printf("Error updating tag '%s': %v\n", tag, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		ErrorLogger.Printf("Error committing transaction: %v\n", err)
+		return
+	}
+
+	c := Command{ID: id}
+	app.loadAnnotations(&c)
+	if len(c.Tags) == 0 {
+		fmt.Printf("Command %d has no tags\n", id)
+		return
+	}
+	fmt.Printf("Command %d tags: %s\n", id, strings.Join(c.Tags, ", "))
+}
+
+func (app *App) noteCommand(cmd *cobra.Command, args []string) {
+	clearNote, _ := cmd.Flags().GetBool("clear")
+
+	id, err := app.parseCommandID(args[0])
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
+
+	text := strings.TrimSpace(strings.Join(args[1:], " "))
+	switch {
+	case clearNote:
+		_, err = app.db.Exec("DELETE FROM notes WHERE command_id = ?", id)
+	case text != "":
+		_, err = app.db.Exec(`
+			INSERT INTO notes (command_id, note, updated_at) VALUES (?, ?, ?)
+			ON CONFLICT(command_id) DO UPDATE SET note = excluded.note, updated_at = excluded.updated_at`,
+			id, app.sealField(text), time.Now(),
+		)
+	default:
+		c := Command{ID: id}
+		app.loadAnnotations(&c)
+		if c.Note == "" {
+			fmt.Printf("Command %d has no note\n", id)
+		} else {
+			fmt.Println(c.Note)
+		}
+		return
+	}
+	if err != nil {
+		ErrorLogger.Printf("Error updating note: %v\n", err)
+		return
+	}
+
+	if clearNote {
+		fmt.Printf("Removed note from command %d\n", id)
+	} else {
+		fmt.Printf("Saved note on command %d\n", id)
+	}
+}
+
+// loadAnnotations fills in the star, tags and note of c.
+func (app *App) loadAnnotations(c *Command) {
+	var starred int
+	err := app.db.QueryRow("SELECT COUNT(*) FROM stars WHERE command_id = ?", c.ID).Scan(&starred)
+	c.Starred = err == nil && starred > 0
+
+	c.Tags = nil
+	rows, err := app.db.Query("SELECT tag FROM tags WHERE command_id = ?", c.ID)
+	if err == nil {
+		for rows.Next() {
+			var tag string
+			if rows.Scan(&tag) == nil {
+				c.Tags = append(c.Tags, app.openField(tag))
+			}
+		}
+		rows.Close()
+		// Encrypted tags don't sort meaningfully in SQL
+		sort.Strings(c.Tags)
+	}
+
+	var note string
+	if app.db.QueryRow("SELECT note FROM notes WHERE command_id = ?", c.ID).Scan(&note) == nil {
+		c.Note = app.openField(note)
+	} else {
+		c.Note = ""
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/spf13/cobra"
+)
+
+// backupFileMode keeps backups as private as the database they copy.
+const backupFileMode = 0600
+
+func (app *App) backupDatabase(cmd *cobra.Command, args []string) {
+	path := args[0]
+	compress, _ := cmd.Flags().GetBool("gzip")
+	keep, _ := cmd.Flags().GetInt("keep")
+
+	if compress && !strings.HasSuffix(path, ".gz") {
+		path += ".gz"
+	}
+
+	if keep > 0 {
+		if err := rotateBackups(path, keep); err != nil {
+			ErrorLogger.Printf("Error rotating backups: %v\n", err)
+			return
+		}
+	}
+
+	if err := app.writeBackup(path, compress); err != nil {
+		ErrorLogger.Printf("Error creating backup: %v\n", err)
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		ErrorLogger.Printf("Error reading backup: %v\n", err)
+		return
+	}
+	fmt.Printf("Backup written to %s (%s)\n", path, formatBytes(info.Size()))
+}
+
+func (app *App) restoreDatabase(_ *cobra.Command, args []string) {
+	path := args[0]
+
+	// Keep the current database around in case the restore was a mistake
+	safety := app.config.DatabasePath + ".pre-restore"
+	if err := app.writeBackup(safety, false); err != nil {
+		ErrorLogger.Printf("Error saving current database: %v\n", err)
+		return
+	}
+
+	if err := app.restoreFrom(path); err != nil {
+		ErrorLogger.Printf("Error restoring backup: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Restored database from %s\n", path)
+	fmt.Printf("Previous database saved to %s\n", safety)
+}
+
+// writeBackup copies the live database to path with SQLite's online backup
+// API, which produces a consistent snapshot even while the WAL is in use.
+func (app *App) writeBackup(path string, compress bool) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	target := path
+	if compress {
+		target = path + ".tmp"
+		defer os.Remove(target)
+	}
+	// The backup API overwrites page by page, so start from an empty file.
+	// SQLite keeps the mode of a file that exists, and backups hold the
+	// whole history, so create it private first.
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, backupFileMode)
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	dest, err := sql.Open("sqlite3", target)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	if err := copyDatabase(dest, app.db); err != nil {
+		return err
+	}
+	// Leave a single self-contained file rather than one in WAL mode
+	if _, err := dest.Exec("PRAGMA journal_mode=DELETE"); err != nil {
+		return err
+	}
+	if err := dest.Close(); err != nil {
+		return err
+	}
+
+	if compress {
+		return gzipFile(target, path)
+	}
+	return nil
+}
+
+// restoreFrom validates the backup at path and copies it over the live
+// database, again through the backup API so open WAL state stays consistent.
+func (app *App) restoreFrom(path string) error {
+	source := path
+	if gzipped, err := isGzipFile(path); err != nil {
+		return err
+	} else if gzipped {
+		tmp, err := os.CreateTemp("", appName+"-restore-*.db")
+		if err != nil {
+			return err
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+		if err := gunzipFile(path, tmp.Name()); err != nil {
+			return fmt.Errorf("failed to decompress backup: %w", err)
+		}
+		source = tmp.Name()
+	}
+
+	src, err := sql.Open("sqlite3", "file:"+source+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := validateBackup(src); err != nil {
+		return err
+	}
+
+	if err := copyDatabase(app.db, src); err != nil {
+		return err
+	}
+
+	// Older backups are brought up to the current schema
+	return migrateDatabase(app.db)
+}
+
+// validateBackup checks that src is an intact bashtrack database whose schema
+// this version understands.
+func validateBackup(src *sql.DB) error {
+	var result string
+	if err := src.QueryRow("PRAGMA quick_check").Scan(&result); err != nil {
+		return fmt.Errorf("not a valid SQLite database: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("backup failed integrity check: %s", result)
+	}
+
+	version, err := schemaVersion(src)
+	if err != nil {
+		return err
+	}
+	if version > latestSchemaVersion() {
+		return fmt.Errorf("backup schema version %d is newer than this version of %s supports (%d)", version, appName, latestSchemaVersion())
+	}
+
+	var tables int
+	if err := src.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'commands'").Scan(&tables); err != nil {
+		return err
+	}
+	if tables == 0 {
+		return errors.New("backup does not contain a commands table")
+	}
+	return nil
+}
+
+// copyDatabase replaces the main database of dest with the one of src.
+func copyDatabase(dest, src *sql.DB) error {
+	ctx := context.Background()
+
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destDriver interface{}) error {
+		return srcConn.Raw(func(srcDriver interface{}) error {
+			destSQLite, ok := destDriver.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.New("destination is not a SQLite connection")
+			}
+			srcSQLite, ok := srcDriver.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.New("source is not a SQLite connection")
+			}
+
+			backup, err := destSQLite.Backup("main", srcSQLite, "main")
+			if err != nil {
+				return err
+			}
+			if _, err := backup.Step(-1); err != nil {
+				backup.Close()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// rotateBackups shifts path to path.1, path.1 to path.2 and so on, keeping at
+// most keep files including the one about to be written.
+func rotateBackups(path string, keep int) error {
+	rotated := func(n int) string {
+		if n == 0 {
+			return path
+		}
+		if strings.HasSuffix(path, ".gz") {
+			return fmt.Sprintf("%s.%d.gz", strings.TrimSuffix(path, ".gz"), n)
+		}
+		return fmt.Sprintf("%s.%d", path, n)
+	}
+
+	if err := os.Remove(rotated(keep - 1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for n := keep - 2; n >= 0; n-- {
+		if err := os.Rename(rotated(n), rotated(n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func gzipFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, backupFileMode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	// An older backup at dest keeps its mode when truncated
+	if err := out.Chmod(backupFileMode); err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func gunzipFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, zr); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func isGzipFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false, nil
+	}
+	return magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
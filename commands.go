@@ -4,38 +4,34 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 )
 
-func (app *App) shouldExclude(command string) bool {
-	for _, pattern := range app.config.ExcludePatterns {
-		matched, err := regexp.MatchString(pattern, command)
-		if err != nil {
-			continue // Skip invalid patterns
-		}
-		if matched {
-			return true
-		}
-	}
-	return false
-}
-
-func (app *App) recordCommand(_ *cobra.Command, args []string) {
+func (app *App) recordCommand(cmd *cobra.Command, args []string) {
 	command := strings.Join(args, " ")
 
+	// Respect per-command and per-session opt-outs before anything else
+	if app.optedOut(command) || isPaused() {
+		return
+	}
+	command = strings.TrimSpace(command)
+
 	wd, err := os.Getwd()
 	if err != nil {
 		wd = "unknown"
 	}
 
 	// Check if command should be excluded
-	if app.shouldExclude(command) {
+	if reason := app.exclusionReason(command, wd); reason != nil {
+		app.countExclusion(reason)
 		return // Silently skip excluded commands
 	}
 
@@ -45,6 +41,23 @@ func (app *App) recordCommand(_ *cobra.Command, args []string) {
 		return // Skip empty commands
 	}
 
+	now := time.Now()
+	run := commandRun{session: currentSession(), timestamp: now, directory: wd}
+	if cmd != nil && cmd.Flags().Changed("exit-code") {
+		exitCode, _ := cmd.Flags().GetInt("exit-code")
+		run.exitCode = sql.NullInt64{Int64: int64(exitCode), Valid: true}
+	}
+	if cmd != nil && cmd.Flags().Changed("history-id") {
+		historyID, _ := cmd.Flags().GetInt("history-id")
+		run.historyID = sql.NullInt64{Int64: int64(historyID), Valid: true}
+	}
+	if rerecord, err := app.isRerecord(run, command); err != nil {
+		ErrorLogger.Printf("Error checking history number: %v\n", err)
+		return
+	} else if rerecord {
+		return
+	}
+
 	// Use a transaction to ensure atomicity
 	tx, err := app.db.Begin()
 	if err != nil {
@@ -54,7 +67,7 @@ func (app *App) recordCommand(_ *cobra.Command, args []string) {
 	defer tx.Rollback() // Safe to call even after commit
 
 	//Check if the command already exists
-	rows, err := app.db.Query("SELECT id FROM commands WHERE full_command = ?", command)
+	rows, err := app.db.Query("SELECT id FROM commands WHERE full_command = ?", app.sealField(command))
 	if err != nil {
 		ErrorLogger.Printf("Error querying commands: %v\n", err)
 		return
@@ -69,24 +82,33 @@ func (app *App) recordCommand(_ *cobra.Command, args []string) {
 			return
 		}
 		//update the time stamp
-		_, err = tx.Exec("UPDATE commands SET timestamp = ? WHERE id = ?", time.Now(), existingCommandID)
+		_, err = tx.Exec("UPDATE commands SET timestamp = ?, run_count = run_count + 1, change_seq = "+nextChangeSeq+" WHERE id = ?", now, existingCommandID)
 		if err != nil {
 			ErrorLogger.Printf("Error updating commands: %v\n", err)
 			return
 		}
+		if err := app.insertRun(tx, int64(existingCommandID), run); err != nil {
+			ErrorLogger.Printf("Error recording run: %v\n", err)
+			return
+		}
 		// Commit the transaction and return
 		if err = tx.Commit(); err != nil {
 			ErrorLogger.Printf("Error committing transaction: %v\n", err)
+			return
 		}
+		app.warnCoveredByAlias(command)
+		app.applyRetentionIfDue()
 		return
 	}
 	rows.Close()
 	// Insert main command record
 	result, err := tx.Exec(
-		"INSERT INTO commands (timestamp, directory, full_command) VALUES (?, ?, ?)",
-		time.Now(),
-		wd,
-		command,
+		"INSERT INTO commands (uuid, host, timestamp, directory, full_command, change_seq) VALUES (?, ?, ?, ?, ?, "+nextChangeSeq+")",
+		newUUID(),
+		app.hostName(),
+		now,
+		app.sealField(wd),
+		app.sealField(command),
 	)
 	if err != nil {
 		ErrorLogger.Printf("Error recording command: %v\n", err)
@@ -99,27 +121,46 @@ func (app *App) recordCommand(_ *cobra.Command, args []string) {
 		return
 	}
 
-	// Insert each word with its position using normalized schema
+	if err := app.insertCommandWords(tx, commandID, words); err != nil {
+		ErrorLogger.Printf("Error recording words: %v\n", err)
+		return
+	}
+
+	if err := app.insertRun(tx, commandID, run); err != nil {
+		ErrorLogger.Printf("Error recording run: %v\n", err)
+		return
+	}
+
+	// Commit the transaction
+	if err = tx.Commit(); err != nil {
+		ErrorLogger.Printf("Error committing transaction: %v\n", err)
+		return
+	}
+	app.warnCoveredByAlias(command)
+	app.applyRetentionIfDue()
+}
+
+// insertCommandWords links each word of a command to it by position, creating
+// entries in the words table as needed.
+func (app *App) insertCommandWords(tx *sql.Tx, commandID int64, words []string) error {
 	for position, word := range words {
+		word = app.sealField(word)
 		// First, get or create the word in the words table
 		var wordID int
-		err = tx.QueryRow("SELECT id FROM words WHERE word = ?", word).Scan(&wordID)
+		err := tx.QueryRow("SELECT id FROM words WHERE word = ?", word).Scan(&wordID)
 		if errors.Is(err, sql.ErrNoRows) {
 			// Word doesn't exist, insert it
 			result, err := tx.Exec("INSERT INTO words (word) VALUES (?)", word)
 			if err != nil {
-				ErrorLogger.Printf("Error inserting word '%s': %v\n", word, err)
-				return
+				return fmt.Errorf("inserting word '%s': %w", word, err)
 			}
 			wordIDInt64, err := result.LastInsertId()
 			if err != nil {
-				ErrorLogger.Printf("Error getting word ID for '%s': %v\n", word, err)
-				return
+				return fmt.Errorf("getting word ID for '%s': %w", word, err)
 			}
 			wordID = int(wordIDInt64)
 		} else if err != nil {
-			ErrorLogger.Printf("Error checking word '%s': %v\n", word, err)
-			return
+			return fmt.Errorf("checking word '%s': %w", word, err)
 		}
 
 		// Insert the word position relationship
@@ -130,67 +171,202 @@ func (app *App) recordCommand(_ *cobra.Command, args []string) {
 			position,
 		)
 		if err != nil {
-			ErrorLogger.Printf("Error recording word position for '%s': %v\n", word, err)
-			return
+			return fmt.Errorf("recording word position for '%s': %w", word, err)
 		}
 	}
+	return nil
+}
 
-	// Commit the transaction
-	if err = tx.Commit(); err != nil {
-		ErrorLogger.Printf("Error committing transaction: %v\n", err)
+func (app *App) listCommands(cmd *cobra.Command, _ []string) {
+	q := commandQueryFromFlags(cmd)
+	q.Limit, _ = cmd.Flags().GetInt("limit")
+	q.Filter, _ = cmd.Flags().GetString("filter")
+	q.Directory, _ = cmd.Flags().GetString("directory")
+
+	out, err := rendererFromFlags(cmd)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
 	}
+	view, err := listViewFromFlags(cmd)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
+
+	commands, err := app.queryCommands(q)
+	if err != nil {
+		ErrorLogger.Printf("Error querying commands: %v\n", err)
+		return
+	}
+
+	if !out.text() {
+		if err := out.render(commandList(commands)); err != nil {
+			ErrorLogger.Printf("Error writing output: %v\n", err)
+		}
+		return
+	}
+
+	if view.compact {
+		view.print(commands)
+		return
+	}
+
+	fmt.Printf("Recent Commands (limit: %d)\n", q.Limit)
+	fmt.Println(strings.Repeat("-", 80))
+	view.print(commands)
 }
 
-func (app *App) listCommands(cmd *cobra.Command, _ []string) {
-	limit, _ := cmd.Flags().GetInt("limit")
-	filter, _ := cmd.Flags().GetString("filter")
-	directory, _ := cmd.Flags().GetString("directory")
+// commandQuery selects commands for list and search. Filter and Directory
+// match substrings; Starred and Tag restrict to annotated commands.
+type commandQuery struct {
+	Filter    string
+	Directory string
+	Starred   bool
+	Tag       string
+	Limit     int
+}
+
+// commandQueryFromFlags reads the annotation filters shared by list and search.
+func commandQueryFromFlags(cmd *cobra.Command) commandQuery {
+	var q commandQuery
+	q.Starred, _ = cmd.Flags().GetBool("starred")
+	q.Tag, _ = cmd.Flags().GetString("tag")
+	return q
+}
 
-	query := "SELECT id, timestamp, full_command, directory FROM commands WHERE 1=1"
+// queryCommands returns the most recent commands matching q, newest first.
+// Encrypted values can't be matched with LIKE, so with encryption enabled the
+// history is decrypted and filtered here instead.
+func (app *App) queryCommands(q commandQuery) ([]Command, error) {
+	// The exit code comes from the latest run
+	query := `
+		SELECT c.id, c.timestamp, c.full_command, c.directory, c.host, r.exit_code
+		FROM commands c
+		LEFT JOIN runs r ON r.id = (
+			SELECT id FROM runs WHERE command_id = c.id ORDER BY timestamp DESC, id DESC LIMIT 1)
+		WHERE 1=1`
 	var queryArgs []interface{}
 
-	if filter != "" {
+	// Stars and tags are exact matches, which work on encrypted values too
+	if q.Starred {
+		query += " AND c.id IN (SELECT command_id FROM stars)"
+	}
+	if q.Tag != "" {
+		query += " AND c.id IN (SELECT command_id FROM tags WHERE tag = ?)"
+		queryArgs = append(queryArgs, app.sealField(q.Tag))
+	}
+
+	if app.cipher != nil {
+		return app.scanCommands(query+" ORDER BY c.timestamp DESC", queryArgs, q)
+	}
+
+	if q.Filter != "" {
 		// Search in both full command and individual words
-		query += " AND (full_command LIKE ? OR id IN (SELECT cwp.command_id FROM command_word_positions cwp JOIN words w ON w.id = cwp.word_id WHERE w.word LIKE ?))"
-		queryArgs = append(queryArgs, "%"+filter+"%", "%"+filter+"%")
+		query += " AND (c.full_command LIKE ? OR c.id IN (SELECT cwp.command_id FROM command_word_positions cwp JOIN words w ON w.id = cwp.word_id WHERE w.word LIKE ?))"
+		queryArgs = append(queryArgs, "%"+q.Filter+"%", "%"+q.Filter+"%")
 	}
 
-	if directory != "" {
-		query += " AND directory LIKE ?"
-		queryArgs = append(queryArgs, "%"+directory+"%")
+	if q.Directory != "" {
+		query += " AND c.directory LIKE ?"
+		queryArgs = append(queryArgs, "%"+q.Directory+"%")
 	}
 
-	query += " ORDER BY timestamp DESC LIMIT ?"
-	queryArgs = append(queryArgs, limit)
+	query += " ORDER BY c.timestamp DESC LIMIT ?"
+	queryArgs = append(queryArgs, q.Limit)
 
 	rows, err := app.db.Query(query, queryArgs...)
 	if err != nil {
-		ErrorLogger.Printf("Error querying commands: %v\n", err)
-		return
+		return nil, err
 	}
 	defer rows.Close()
 
-	fmt.Printf("Recent Commands (limit: %d)\n", limit)
-	fmt.Println(strings.Repeat("-", 80))
-
+	var commands []Command
 	for rows.Next() {
 		var c Command
-		err := rows.Scan(&c.ID, &c.Timestamp, &c.Command, &c.Directory)
-		if err != nil {
+		var exitCode sql.NullInt64
+		if err := rows.Scan(&c.ID, &c.Timestamp, &c.Command, &c.Directory, &c.Host, &exitCode); err != nil {
 			continue
 		}
+		c.ExitCode = exitCodePointer(exitCode)
+		commands = append(commands, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return app.withDetails(commands), nil
+}
+
+// scanCommands is queryCommands for an encrypted database. Matching is case
+// insensitive like SQL LIKE.
+func (app *App) scanCommands(query string, queryArgs []interface{}, q commandQuery) ([]Command, error) {
+	rows, err := app.db.Query(query, queryArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-		// Load individual words for this command
-		c.Words, _ = app.loadCommandWords(c.ID)
+	filter := strings.ToLower(q.Filter)
+	directory := strings.ToLower(q.Directory)
 
-		fmt.Printf("[%d] %s\n", c.ID, c.Timestamp.Format("2006-01-02 15:04:05"))
-		fmt.Printf("    Dir: %s\n", c.Directory)
-		fmt.Printf("    Cmd: %s\n", c.Command)
-		if len(c.Words) > 0 {
-			fmt.Printf("    Words: [%s]\n", strings.Join(c.Words, "] ["))
+	var commands []Command
+	for rows.Next() && len(commands) < q.Limit {
+		var c Command
+		var exitCode sql.NullInt64
+		if err := rows.Scan(&c.ID, &c.Timestamp, &c.Command, &c.Directory, &c.Host, &exitCode); err != nil {
+			continue
+		}
+		c.ExitCode = exitCodePointer(exitCode)
+		app.openCommand(&c)
+		if !strings.Contains(strings.ToLower(c.Command), filter) ||
+			!strings.Contains(strings.ToLower(c.Directory), directory) {
+			continue
 		}
-		fmt.Println()
+		commands = append(commands, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
+	rows.Close()
+	return app.withDetails(commands), nil
+}
+
+// withDetails loads the individual words and annotations of each command.
+func (app *App) withDetails(commands []Command) []Command {
+	for i := range commands {
+		commands[i].Words, _ = app.loadCommandWords(commands[i].ID)
+		app.loadAnnotations(&commands[i])
+	}
+	return commands
+}
+
+// exitCodePointer returns the exit status of a run, or nil when it was not
+// recorded.
+func exitCodePointer(exitCode sql.NullInt64) *int {
+	if !exitCode.Valid {
+		return nil
+	}
+	code := int(exitCode.Int64)
+	return &code
+}
+
+func printCommand(c Command) {
+	fmt.Printf("[%d] %s\n", c.ID, c.Timestamp.Format("2006-01-02 15:04:05"))
+	fmt.Printf("    Dir: %s\n", c.Directory)
+	fmt.Printf("    Cmd: %s\n", c.Command)
+	if len(c.Words) > 0 {
+		fmt.Printf("    Words: [%s]\n", strings.Join(c.Words, "] ["))
+	}
+	if c.Starred {
+		fmt.Println("    Starred")
+	}
+	if len(c.Tags) > 0 {
+		fmt.Printf("    Tags: %s\n", strings.Join(c.Tags, ", "))
+	}
+	if c.Note != "" {
+		fmt.Printf("    Note: %s\n", c.Note)
+	}
+	fmt.Println()
 }
 
 // Helper function to load individual words for a command
@@ -214,271 +390,671 @@ func (app *App) loadCommandWords(commandID int) ([]string, error) {
 		if err := rows.Scan(&word); err != nil {
 			continue
 		}
-		words = append(words, word)
+		words = append(words, app.openField(word))
 	}
 
 	return words, nil
 }
 
-func (app *App) searchCommands(_ *cobra.Command, args []string) {
+func (app *App) searchCommands(cmd *cobra.Command, args []string) {
 	pattern := args[0]
 
 	// Enhanced search that looks in both full commands and individual words
-	rows, err := app.db.Query(`
-		SELECT DISTINCT c.id, c.timestamp, c.full_command, c.directory 
-		FROM commands c 
-		LEFT JOIN command_word_positions cwp ON c.id = cwp.command_id 
-		LEFT JOIN words w ON w.id = cwp.word_id
-		WHERE c.full_command LIKE ? OR w.word LIKE ? 
-		ORDER BY c.timestamp DESC LIMIT 50`,
-		"%"+pattern+"%", "%"+pattern+"%",
-	)
+	q := commandQueryFromFlags(cmd)
+	q.Filter = pattern
+	q.Limit = 50
+
+	out, err := rendererFromFlags(cmd)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
+	view, err := listViewFromFlags(cmd)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
+
+	commands, err := app.queryCommands(q)
 	if err != nil {
 		ErrorLogger.Printf("Error searching commands: %v\n", err)
 		return
 	}
-	defer rows.Close()
+
+	if !out.text() {
+		if err := out.render(commandList(commands)); err != nil {
+			ErrorLogger.Printf("Error writing output: %v\n", err)
+		}
+		return
+	}
+
+	if len(commands) == 0 {
+		fmt.Println("No commands found matching the pattern.")
+		return
+	}
+
+	if view.compact {
+		view.print(commands)
+		return
+	}
 
 	fmt.Printf("Commands matching '%s':\n", pattern)
 	fmt.Println(strings.Repeat("-", 80))
+	view.print(commands)
+}
 
-	count := 0
-	for rows.Next() {
-		var c Command
-		err := rows.Scan(&c.ID, &c.Timestamp, &c.Command, &c.Directory)
-		if err != nil {
-			continue
-		}
+// countEntry is a value with how often it occurs, for top-N lists.
+type countEntry struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
 
-		// Load individual words for this command
-		c.Words, _ = app.loadCommandWords(c.ID)
+// commandStats is what stats reports about the commands in a scope.
+type commandStats struct {
+	Directory      string       `json:"directory,omitempty"`
+	Recursive      bool         `json:"recursive,omitempty"`
+	Total          int          `json:"total"`
+	Oldest         time.Time    `json:"oldest"`
+	Newest         time.Time    `json:"newest"`
+	TopDirectories []countEntry `json:"top_directories"`
+	TopCommands    []countEntry `json:"top_commands"`
+	TopWords       []countEntry `json:"top_words"`
+}
 
-		fmt.Printf("[%d] %s\n", c.ID, c.Timestamp.Format("2006-01-02 15:04:05"))
-		fmt.Printf("    Dir: %s\n", c.Directory)
-		fmt.Printf("    Cmd: %s\n", c.Command)
-		if len(c.Words) > 0 {
-			fmt.Printf("    Words: [%s]\n", strings.Join(c.Words, "] ["))
-		}
-		fmt.Println()
-		count++
+func (app *App) showStats(cmd *cobra.Command, _ []string) {
+	scope, err := directoryScopeFromFlags(cmd)
+	if err != nil {
+		ErrorLogger.Printf("Error resolving directory: %v\n", err)
+		return
 	}
 
-	if count == 0 {
-		fmt.Println("No commands found matching the pattern.")
+	out, err := rendererFromFlags(cmd)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
 	}
-}
 
-func (app *App) showStats(_ *cobra.Command, _ []string) {
-	var totalCommands int
-	err := app.db.QueryRow("SELECT COUNT(*) FROM commands").Scan(&totalCommands)
+	stats, err := app.collectStats(scope)
 	if err != nil {
-		ErrorLogger.Printf("Error getting total commands: %v\n", err)
+		ErrorLogger.Printf("Error collecting statistics: %v\n", err)
 		return
 	}
 
-	var oldestDateStr, newestDateStr sql.NullString
-	err = app.db.QueryRow("SELECT MIN(timestamp), MAX(timestamp) FROM commands").Scan(&oldestDateStr, &newestDateStr)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		ErrorLogger.Printf("Error getting date range: %v\n", err)
+	if !out.text() {
+		if err := out.render(stats); err != nil {
+			ErrorLogger.Printf("Error writing output: %v\n", err)
+		}
 		return
 	}
 
 	fmt.Println("Command Tracking Statistics")
 	fmt.Println(strings.Repeat("=", 40))
-	fmt.Printf("Total commands: %d\n\n", totalCommands)
-
-	if oldestDateStr.Valid && newestDateStr.Valid {
-		// Parse the timestamp strings to time.Time
-		oldestDate, err1 := time.Parse("2006-01-02 15:04:05.999999999-07:00", oldestDateStr.String)
-		newestDate, err2 := time.Parse("2006-01-02 15:04:05.999999999-07:00", newestDateStr.String)
+	if stats.Directory != "" {
+		if stats.Recursive {
+			fmt.Printf("Directory: %s (and subdirectories)\n", stats.Directory)
+		} else {
+			fmt.Printf("Directory: %s\n", stats.Directory)
+		}
+	}
+	fmt.Printf("Total commands: %d\n\n", stats.Total)
 
-		if err1 == nil && err2 == nil {
-			fmt.Printf("Date range: %s to %s\n",
-				oldestDate.Format("2006-01-02"),
-				newestDate.Format("2006-01-02"))
+	if stats.Total > 0 {
+		fmt.Printf("Date range: %s to %s\n",
+			stats.Oldest.Format("2006-01-02"),
+			stats.Newest.Format("2006-01-02"))
 
-			days := int(newestDate.Sub(oldestDate).Hours() / 24)
-			if days > 0 {
-				fmt.Printf("Average per day: %.1f\n", float64(totalCommands)/float64(days))
-			}
-		} else {
-			fmt.Println("Error parsing date strings.")
+		days := int(stats.Newest.Sub(stats.Oldest).Hours() / 24)
+		if days > 0 {
+			fmt.Printf("Average per day: %.1f\n", float64(stats.Total)/float64(days))
 		}
 	}
 
 	// Top directories
 	fmt.Println("\nTop Directories:")
-	rows, err := app.db.Query(`
-		SELECT directory, COUNT(*) as count 
-		FROM commands 
-		GROUP BY directory 
-		ORDER BY count DESC 
-		LIMIT 10
-	`)
-	if err == nil {
-		defer rows.Close()
-		for rows.Next() {
-			var dir string
-			var count int
-			rows.Scan(&dir, &count)
-			fmt.Printf("  %s: %d\n", dir, count)
-		}
-	}
-
-	// Most used commands (using full_command instead of command)
+	for _, e := range stats.TopDirectories {
+		fmt.Printf("  %s: %d\n", e.Value, e.Count)
+	}
+
+	// Most used commands
 	fmt.Println("\nMost Used Commands:")
-	rows, err = app.db.Query(`
-		SELECT full_command, COUNT(*) as count 
-		FROM commands 
-		GROUP BY full_command 
-		ORDER BY count DESC 
-		LIMIT 10
-	`)
-	if err == nil {
-		defer rows.Close()
-		for rows.Next() {
-			var command string
-			var count int
-			rows.Scan(&command, &count)
-			// Truncate long commands
-			if len(command) > 50 {
-				command = command[:50] + "..."
-			}
-			fmt.Printf("  %s: %d\n", command, count)
+	for _, e := range stats.TopCommands {
+		command := e.Value
+		// Truncate long commands
+		if len(command) > 50 {
+			command = command[:50] + "..."
 		}
+		fmt.Printf("  %s: %d\n", command, e.Count)
 	}
 
 	// Most used individual words
 	fmt.Println("\nMost Used Words:")
+	for _, e := range stats.TopWords {
+		fmt.Printf("  %s: %d\n", e.Value, e.Count)
+	}
+}
+
+// collectStats counts the commands run in scope, by the directory of each
+// run. Directories and commands are counted in runs; words once per command.
+func (app *App) collectStats(scope directoryScope) (commandStats, error) {
+	stats := commandStats{Directory: scope.dir, Recursive: scope.recursive}
+	if app.cipher == nil && scope.dir == "" {
+		return app.aggregateStats(stats)
+	}
+
+	// Directories are compared after decryption, so the counting happens
+	// here, not in SQL
+	rows, err := app.db.Query(`
+		SELECT r.command_id, r.directory, c.full_command, COUNT(*), MIN(r.timestamp), MAX(r.timestamp)
+		FROM runs r JOIN commands c ON c.id = r.command_id
+		GROUP BY r.command_id, r.directory`)
+	if err != nil {
+		return stats, err
+	}
+	inScope := map[int]bool{}
+	directories := map[string]int{}
+	commands := map[string]int{}
+	for rows.Next() {
+		var id, runs int
+		var dir, command, oldestStr, newestStr string
+		if err := rows.Scan(&id, &dir, &command, &runs, &oldestStr, &newestStr); err != nil {
+			rows.Close()
+			return stats, err
+		}
+		dir = app.openField(dir)
+		if !scope.matches(dir) {
+			continue
+		}
+		inScope[id] = true
+		oldest, err := parseSQLiteTime(oldestStr)
+		if err != nil {
+			rows.Close()
+			return stats, err
+		}
+		newest, err := parseSQLiteTime(newestStr)
+		if err != nil {
+			rows.Close()
+			return stats, err
+		}
+		if stats.Oldest.IsZero() || oldest.Before(stats.Oldest) {
+			stats.Oldest = oldest
+		}
+		if newest.After(stats.Newest) {
+			stats.Newest = newest
+		}
+		directories[dir] += runs
+		commands[app.openField(command)] += runs
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return stats, err
+	}
+	stats.Total = len(inScope)
+
 	rows, err = app.db.Query(`
-		SELECT w.word, COUNT(*) as count 
+		SELECT cwp.command_id, w.word
+		FROM command_word_positions cwp
+		JOIN words w ON w.id = cwp.word_id`)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+	words := map[string]int{}
+	for rows.Next() {
+		var id int
+		var word string
+		if err := rows.Scan(&id, &word); err != nil {
+			return stats, err
+		}
+		if inScope[id] {
+			words[app.openField(word)]++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return stats, err
+	}
+
+	stats.TopDirectories = topCounts(directories, 10)
+	stats.TopCommands = topCounts(commands, 10)
+	stats.TopWords = topCounts(words, 15)
+	return stats, nil
+}
+
+// aggregateStats is collectStats for the whole unencrypted database, where
+// SQL can do the grouping.
+func (app *App) aggregateStats(stats commandStats) (commandStats, error) {
+	var oldestStr, newestStr sql.NullString
+	err := app.db.QueryRow("SELECT COUNT(DISTINCT command_id), MIN(timestamp), MAX(timestamp) FROM runs").
+		Scan(&stats.Total, &oldestStr, &newestStr)
+	if err != nil {
+		return stats, err
+	}
+	if oldestStr.Valid && newestStr.Valid {
+		if stats.Oldest, err = parseSQLiteTime(oldestStr.String); err != nil {
+			return stats, err
+		}
+		if stats.Newest, err = parseSQLiteTime(newestStr.String); err != nil {
+			return stats, err
+		}
+	}
+
+	if stats.TopDirectories, err = app.queryCounts(`
+		SELECT directory, COUNT(*) AS count FROM runs
+		GROUP BY directory ORDER BY count DESC, directory LIMIT 10`); err != nil {
+		return stats, err
+	}
+	if stats.TopCommands, err = app.queryCounts(`
+		SELECT c.full_command, COUNT(*) AS count
+		FROM runs r JOIN commands c ON c.id = r.command_id
+		GROUP BY r.command_id ORDER BY count DESC, c.full_command LIMIT 10`); err != nil {
+		return stats, err
+	}
+	stats.TopWords, err = app.queryCounts(`
+		SELECT w.word, COUNT(*) AS count
 		FROM command_word_positions cwp
 		JOIN words w ON w.id = cwp.word_id
-		GROUP BY w.word 
-		ORDER BY count DESC 
-		LIMIT 15
-	`)
-	if err == nil {
-		defer rows.Close()
-		for rows.Next() {
-			var word string
-			var count int
-			rows.Scan(&word, &count)
-			fmt.Printf("  %s: %d\n", word, count)
+		GROUP BY w.word ORDER BY count DESC, w.word LIMIT 15`)
+	return stats, err
+}
+
+// queryCounts reads value and count pairs.
+func (app *App) queryCounts(query string) ([]countEntry, error) {
+	rows, err := app.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []countEntry{}
+	for rows.Next() {
+		var e countEntry
+		if err := rows.Scan(&e.Value, &e.Count); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// topCounts returns the n most frequent values, ties in alphabetical order.
+func topCounts(counts map[string]int, n int) []countEntry {
+	entries := make([]countEntry, 0, len(counts))
+	for value, count := range counts {
+		entries = append(entries, countEntry{Value: value, Count: count})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
 		}
+		return entries[i].Value < entries[j].Value
+	})
+	if len(entries) > n {
+		entries = entries[:n]
 	}
+	return entries
+}
+
+// configReport is what config show reports about the configuration.
+type configReport struct {
+	Database       string           `json:"database"`
+	FilterRules    []ruleReport     `json:"filter_rules"`
+	DirectoryRules []ruleReport     `json:"directory_rules,omitempty"`
+	IncludeOnly    bool             `json:"directory_include_only,omitempty"`
+	Retention      *RetentionConfig `json:"retention,omitempty"`
+}
+
+// ruleReport is a filter or directory rule in evaluation order. Action is
+// "invalid" for rules that fail to parse, with Pattern holding the source.
+type ruleReport struct {
+	Position int    `json:"position"`
+	Action   string `json:"action"`
+	Pattern  string `json:"pattern"`
 }
 
-func (app *App) showConfig(_ *cobra.Command, _ []string) {
+func (app *App) buildConfigReport() configReport {
+	report := configReport{Database: app.config.DatabasePath, FilterRules: []ruleReport{}}
+	for i, source := range app.config.ExcludePatterns {
+		rule, err := parseRule(source)
+		if err != nil {
+			report.FilterRules = append(report.FilterRules, ruleReport{Position: i + 1, Action: "invalid", Pattern: source})
+			continue
+		}
+		report.FilterRules = append(report.FilterRules, ruleReport{Position: i + 1, Action: rule.action(), Pattern: rule.pattern})
+	}
+	for i, source := range app.config.DirectoryRules {
+		rule, err := parseDirRule(source)
+		if err != nil {
+			report.DirectoryRules = append(report.DirectoryRules, ruleReport{Position: i + 1, Action: "invalid", Pattern: source})
+			continue
+		}
+		report.DirectoryRules = append(report.DirectoryRules, ruleReport{Position: i + 1, Action: rule.action(), Pattern: rule.pattern})
+	}
+	report.IncludeOnly = app.config.DirectoryIncludeOnly
+	if policy := app.config.Retention; policy.enabled() {
+		report.Retention = &policy
+	}
+	return report
+}
+
+func (app *App) showConfig(cmd *cobra.Command, _ []string) {
+	out, err := rendererFromFlags(cmd)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
+
+	report := app.buildConfigReport()
+	if !out.text() {
+		if err := out.render(report); err != nil {
+			ErrorLogger.Printf("Error writing output: %v\n", err)
+		}
+		return
+	}
+
 	fmt.Println("Current Configuration:")
 	fmt.Println(strings.Repeat("=", 30))
-	fmt.Printf("Database: %s\n", app.config.DatabasePath)
-	fmt.Println("\nExclude Patterns:")
-	for i, pattern := range app.config.ExcludePatterns {
-		fmt.Printf("  %d. %s\n", i+1, pattern)
+	fmt.Printf("Database: %s\n", report.Database)
+	fmt.Println("\nFilter Rules (first match wins):")
+	for _, rule := range report.FilterRules {
+		fmt.Printf("  %d. %-8s %s\n", rule.Position, rule.Action, rule.Pattern)
+	}
+	if len(report.DirectoryRules) > 0 {
+		fmt.Println("\nDirectory Rules (first match wins):")
+		for _, rule := range report.DirectoryRules {
+			fmt.Printf("  %d. %-8s %s\n", rule.Position, rule.Action, rule.Pattern)
+		}
+	}
+	if report.IncludeOnly {
+		fmt.Println("\nInclude-only: directories no include rule matches are not recorded")
+	}
+
+	if policy := report.Retention; policy != nil {
+		fmt.Println("\nRetention Policy:")
+		if policy.MaxAgeDays > 0 {
+			fmt.Printf("  Max age: %d days\n", policy.MaxAgeDays)
+		}
+		for _, ttl := range policy.TTLs {
+			fmt.Printf("  %s: %d days\n", ttl.Pattern, ttl.Days)
+		}
+		if policy.MaxRows > 0 {
+			fmt.Printf("  Max commands: %d\n", policy.MaxRows)
+		}
+		if policy.MaxDBSizeMB > 0 {
+			fmt.Printf("  Max database size: %d MB\n", policy.MaxDBSizeMB)
+		}
+		if policy.KeepFrequent > 0 {
+			fmt.Printf("  Always keep commands run %d+ times\n", policy.KeepFrequent)
+		}
+		if policy.CheckEvery > 0 {
+			fmt.Printf("  Applied every %d recorded commands\n", policy.CheckEvery)
+		}
 	}
 }
 
-func (app *App) addExcludePattern(_ *cobra.Command, args []string) {
-	pattern := args[0]
+func (app *App) addExcludePattern(cmd *cobra.Command, args []string) {
+	position, _ := cmd.Flags().GetInt("position")
+	app.addRule(excludeRuleSource(args[0]), position)
+}
+
+func (app *App) addIncludePattern(cmd *cobra.Command, args []string) {
+	position, _ := cmd.Flags().GetInt("position")
+	app.addRule(includeRuleSource(args[0]), position)
+}
+
+func (app *App) addRule(source string, position int) {
+	rule, err := parseRule(source)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
 
-	// Check if pattern already exists
+	// Check if rule already exists
 	for _, existing := range app.config.ExcludePatterns {
-		if existing == pattern {
-			fmt.Printf("Pattern '%s' already exists\n", pattern)
+		if existing == source {
+			fmt.Printf("Pattern '%s' already exists\n", rule.pattern)
 			return
 		}
 	}
 
-	app.config.ExcludePatterns = append(app.config.ExcludePatterns, pattern)
+	app.config.ExcludePatterns = insertRule(app.config.ExcludePatterns, source, position)
+	app.config.compilePatterns()
 
-	configDir, _ := getConfigDir()
-	configPath := filepath.Join(configDir, configFile)
-
-	_, err := saveConfig(configPath, app.config)
-	if err != nil {
+	if err := app.persistConfig(); err != nil {
 		ErrorLogger.Printf("Error saving config: %v\n", err)
 		return
 	}
 
-	fmt.Printf("Added exclude pattern: %s\n", pattern)
+	fmt.Printf("Added %s pattern: %s\n", rule.action(), rule.pattern)
 }
 
 func (app *App) removeExcludePattern(_ *cobra.Command, args []string) {
-	pattern := args[0]
+	app.removeRule(excludeRuleSource(args[0]))
+}
+
+func (app *App) removeIncludePattern(_ *cobra.Command, args []string) {
+	app.removeRule(includeRuleSource(args[0]))
+}
+
+func (app *App) removeRule(source string) {
+	rule, _ := parseRule(source)
 
 	for i, existing := range app.config.ExcludePatterns {
-		if existing == pattern {
+		if existing == source {
 			app.config.ExcludePatterns = append(app.config.ExcludePatterns[:i], app.config.ExcludePatterns[i+1:]...)
+			app.config.compilePatterns()
 
-			configDir, _ := getConfigDir()
-			configPath := filepath.Join(configDir, configFile)
+			if err := app.persistConfig(); err != nil {
+				ErrorLogger.Printf("Error saving config: %v\n", err)
+				return
+			}
 
-			_, err := saveConfig(configPath, app.config)
-			if err != nil {
+			fmt.Printf("Removed %s pattern: %s\n", rule.action(), rule.pattern)
+			return
+		}
+	}
+
+	fmt.Printf("Pattern '%s' not found\n", rule.pattern)
+}
+
+func (app *App) addDirRule(cmd *cobra.Command, args []string) {
+	source := args[0]
+	position, _ := cmd.Flags().GetInt("position")
+
+	if _, err := parseDirRule(source); err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
+
+	for _, existing := range app.config.DirectoryRules {
+		if existing == source {
+			fmt.Printf("Directory rule '%s' already exists\n", source)
+			return
+		}
+	}
+
+	app.config.DirectoryRules = insertRule(app.config.DirectoryRules, source, position)
+	app.config.compileDirRules()
+
+	if err := app.persistConfig(); err != nil {
+		ErrorLogger.Printf("Error saving config: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Added directory rule: %s\n", source)
+}
+
+func (app *App) removeDirRule(_ *cobra.Command, args []string) {
+	source := args[0]
+
+	for i, existing := range app.config.DirectoryRules {
+		if existing == source {
+			app.config.DirectoryRules = append(app.config.DirectoryRules[:i], app.config.DirectoryRules[i+1:]...)
+			app.config.compileDirRules()
+
+			if err := app.persistConfig(); err != nil {
 				ErrorLogger.Printf("Error saving config: %v\n", err)
 				return
 			}
 
-			fmt.Printf("Removed exclude pattern: %s\n", pattern)
+			fmt.Printf("Removed directory rule: %s\n", source)
 			return
 		}
 	}
 
-	fmt.Printf("Pattern '%s' not found\n", pattern)
+	fmt.Printf("Directory rule '%s' not found\n", source)
 }
 
-func (app *App) cleanupCommands(cmd *cobra.Command, _ []string) {
-	days, _ := cmd.Flags().GetInt("days")
-	cutoff := time.Now().AddDate(0, 0, -days)
+func (app *App) setDirIncludeOnly(_ *cobra.Command, args []string) {
+	switch args[0] {
+	case "on":
+		app.config.DirectoryIncludeOnly = true
+	case "off":
+		app.config.DirectoryIncludeOnly = false
+	default:
+		ErrorLogger.Printf("Invalid value %q: use on or off\n", args[0])
+		return
+	}
 
-	// Use a transaction to ensure atomicity
-	tx, err := app.db.Begin()
-	if err != nil {
-		ErrorLogger.Printf("Error beginning transaction: %v\n", err)
+	if err := app.persistConfig(); err != nil {
+		ErrorLogger.Printf("Error saving config: %v\n", err)
 		return
 	}
-	defer tx.Rollback() // Safe to call even after commit
 
-	// Delete command_word_positions for commands older than cutoff
-	_, err = tx.Exec(`
-    DELETE FROM command_word_positions 
-    WHERE command_id IN (
-        SELECT id FROM commands WHERE timestamp < ?
-    )`, cutoff)
-	if err != nil {
-		ErrorLogger.Printf("Error cleaning up command word positions: %v\n", err)
+	if app.config.DirectoryIncludeOnly {
+		fmt.Println("Include-only mode on: recording only in directories matched by an include rule")
+		if !app.hasIncludeDirRule() {
+			fmt.Println("Warning: there are no include directory rules, so nothing will be recorded")
+		}
 		return
 	}
+	fmt.Println("Include-only mode off")
+}
+
+// hasIncludeDirRule reports whether any directory rule is an include rule.
+func (app *App) hasIncludeDirRule() bool {
+	for _, source := range app.config.DirectoryRules {
+		if rule, err := parseDirRule(source); err == nil && rule.include {
+			return true
+		}
+	}
+	return false
+}
+
+func (app *App) cleanupCommands(cmd *cobra.Command, _ []string) {
+	days, _ := cmd.Flags().GetInt("days")
+	usePolicy, _ := cmd.Flags().GetBool("policy")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
 
-	// Delete old commands
-	result2, err := tx.Exec("DELETE FROM commands WHERE timestamp < ?", cutoff)
+	sel, err := cleanupSelectionFromFlags(cmd)
 	if err != nil {
-		ErrorLogger.Printf("Error cleaning up commands: %v\n", err)
+		ErrorLogger.Println(err)
 		return
 	}
 
-	affected, _ := result2.RowsAffected()
+	// Expire old trash first so the undo window is honoured even when
+	// cleanup is only run by hand
+	if !dryRun {
+		if _, err := app.expireTrash(); err != nil {
+			ErrorLogger.Printf("Warning: could not empty trash: %v\n", err)
+		}
+	}
 
-	// Delete old words
-	_, err = tx.Exec("DELETE FROM words WHERE id NOT IN (SELECT word_id FROM command_word_positions)")
+	var matches []retentionMatch
+	switch {
+	case usePolicy:
+		if !app.config.Retention.enabled() {
+			fmt.Println("No retention policy configured; set \"retention\" in the config")
+			return
+		}
+		matches, err = app.findRetentionMatches(app.config.Retention, time.Now())
+	case sel.empty() || cmd.Flags().Changed("days"):
+		matches, err = app.findRetentionMatches(RetentionConfig{MaxAgeDays: days}, time.Now())
+	default:
+		// A selection on its own picks commands regardless of age
+		matches, err = app.selectCommands(sel)
+	}
 	if err != nil {
-		ErrorLogger.Printf("Error cleaning up words: %v\n", err)
+		ErrorLogger.Printf("Error selecting commands: %v\n", err)
+		return
 	}
 
-	// Commit the transaction
-	if err = tx.Commit(); err != nil {
-		ErrorLogger.Printf("Error committing cleanup transaction: %v\n", err)
+	selected := matches[:0]
+	for _, m := range matches {
+		if sel.matches(m.Entry) {
+			selected = append(selected, m)
+		}
+	}
+	matches = selected
+
+	if dryRun {
+		fmt.Printf("Would remove %d command(s):\n", len(matches))
+		for _, m := range matches {
+			fmt.Printf("  [%d] %s  %s  %s  (%s)\n", m.Entry.ID, m.Entry.Timestamp.Format("2006-01-02"), m.Entry.Directory, m.Entry.Command, m.Reason)
+		}
 		return
 	}
 
+	var affected int64
+	if len(matches) > 0 {
+		affected, err = app.trashCommands(retentionIDs(matches))
+		if err != nil {
+			ErrorLogger.Printf("Error cleaning up commands: %v\n", err)
+			return
+		}
+	}
+
+	var pruned int64
+	if usePolicy {
+		if pruned, err = app.pruneRuns(app.config.Retention, time.Now(), 0); err != nil {
+			ErrorLogger.Printf("Warning: could not prune runs: %v\n", err)
+		}
+	}
+
 	fmt.Printf("Cleanup completed:\n")
-	fmt.Printf("  - Removed %d commands older than %d days\n", affected, days)
+	fmt.Printf("  - Moved %d commands to the trash\n", affected)
+	if pruned > 0 {
+		fmt.Printf("  - Removed %d runs older than the age limit\n", pruned)
+	}
+	if affected > 0 {
+		fmt.Printf("  - Undo with '%s trash restore' within %d days\n", appName, app.config.Retention.TrashDays)
+	}
+}
 
-	_, err = app.db.Exec("VACUUM")
-	if err != nil {
-		ErrorLogger.Printf("Warning: Could not vacuum database: %v\n", err)
+// cleanupSelectionFromFlags reads --directory, --pattern, --host, --before and
+// --after.
+func cleanupSelectionFromFlags(cmd *cobra.Command) (cleanupSelection, error) {
+	var sel cleanupSelection
+	directory, _ := cmd.Flags().GetString("directory")
+	pattern, _ := cmd.Flags().GetString("pattern")
+	before, _ := cmd.Flags().GetString("before")
+	after, _ := cmd.Flags().GetString("after")
+	sel.host, _ = cmd.Flags().GetString("host")
+
+	if directory != "" {
+		dir, err := expandHome(directory)
+		if err != nil {
+			return sel, err
+		}
+		if sel.directory, err = filepath.Abs(dir); err != nil {
+			return sel, err
+		}
+	}
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return sel, fmt.Errorf("invalid pattern: %w", err)
+		}
+		sel.pattern = re
 	}
+
+	var err error
+	now := time.Now()
+	if sel.before, err = parseTimeFlag(before, now); err != nil {
+		return sel, err
+	}
+	if sel.after, err = parseTimeFlag(after, now); err != nil {
+		return sel, err
+	}
+	return sel, nil
 }
 
 func (app *App) showSetupInstructions(_ *cobra.Command, _ []string) {
@@ -490,31 +1066,57 @@ func (app *App) showSetupInstructions(_ *cobra.Command, _ []string) {
 	fmt.Println("Bash Command Tracker Setup Instructions")
 	fmt.Println(strings.Repeat("=", 50))
 	fmt.Println()
-	fmt.Println("Method 1 (Recommended): Using fc command")
+	fmt.Println("Method 1 (Recommended): Prompt hook")
 	fmt.Println("Add the following to your ~/.bashrc:")
 	fmt.Println()
 	fmt.Printf("# BashTrack command recording\n")
-	fmt.Printf("bashtrack_record() {\n")
-	fmt.Printf("    local last_cmd=$(fc -ln -1 2>/dev/null | sed 's/^[ \\t]*//')\n")
-	fmt.Printf("    if [[ -n \"$last_cmd\" && \"$last_cmd\" != bashtrack* ]]; then\n")
-	fmt.Printf("        %s record \"$last_cmd\" 2>/dev/null\n", execPath)
-	fmt.Printf("    fi\n")
-	fmt.Printf("}\n")
-	fmt.Printf("export PROMPT_COMMAND=\"${PROMPT_COMMAND:+$PROMPT_COMMAND$'\\n'}bashtrack_record\"\n")
+	fmt.Printf("export %s=\"$$-$(date +%%s)\"  # one session per shell, for 'bashtrack context'\n", sessionEnv)
+	printRecordFunction(os.Stdout, execPath, true)
+	fmt.Printf("# Runs first so it sees the exit status of the command\n")
+	fmt.Printf("export PROMPT_COMMAND=\"bashtrack_record${PROMPT_COMMAND:+$'\\n'$PROMPT_COMMAND}\"\n")
 	fmt.Println()
-	fmt.Println("Method 2: Using history command (fallback)")
-	fmt.Println("If Method 1 doesn't work, try:")
+	fmt.Println("Method 2 (Fallback: history -a)")
+	fmt.Println("Also appends every command to the history file right away:")
 	fmt.Println()
-	fmt.Printf("# Enable immediate history recording\n")
+	fmt.Printf("# Enable immediate history append\n")
 	fmt.Printf("shopt -s histappend\n")
 	fmt.Printf("export HISTCONTROL=ignoredups:erasedups\n")
 	fmt.Printf("export HISTSIZE=10000\n")
 	fmt.Printf("export HISTFILESIZE=20000\n")
-	fmt.Printf("export PROMPT_COMMAND=\"history -a; ${PROMPT_COMMAND:+$PROMPT_COMMAND$'\\n'}%s record\"\n", execPath)
+	fmt.Println()
+	printRecordFunction(os.Stdout, execPath, false)
+	fmt.Printf("export PROMPT_COMMAND=\"bashtrack_record; history -a${PROMPT_COMMAND:+$'\\n'$PROMPT_COMMAND}\"\n")
+	fmt.Println()
+	fmt.Println("Optional: press Ctrl-X Ctrl-N to fill in the most likely next command")
+	fmt.Println()
+	fmt.Printf("bashtrack_suggest() {\n")
+	fmt.Printf("    READLINE_LINE=$(%s suggest -n 1 2>/dev/null)\n", execPath)
+	fmt.Printf("    READLINE_POINT=${#READLINE_LINE}\n")
+	fmt.Printf("}\n")
+	fmt.Printf("bind -x '\"\\C-x\\C-n\": bashtrack_suggest'\n")
 	fmt.Println()
 	fmt.Println("After adding either method to ~/.bashrc, reload it with:")
 	fmt.Println("  source ~/.bashrc")
 	fmt.Println()
 	fmt.Println("Note: The tool automatically excludes common commands and sensitive patterns.")
 	fmt.Println("You can customize exclusions using 'config add-exclude' and 'config remove-exclude'.")
+	fmt.Println("Prefix a command with a space or end it with '#nobt' to keep it out, or use 'bashtrack pause'.")
+}
+
+// printRecordFunction prints the bashtrack_record shell function both setup
+// methods call from PROMPT_COMMAND.
+func printRecordFunction(w io.Writer, execPath string, explain bool) {
+	fmt.Fprintf(w, "bashtrack_record() {\n")
+	fmt.Fprintf(w, "    local exit_code=$? hist_id last_cmd\n")
+	fmt.Fprintf(w, "    local entry=$(HISTTIMEFORMAT= history 1)\n")
+	if explain {
+		fmt.Fprintf(w, "    # The history number keeps an empty Enter from recording the command again\n")
+	}
+	fmt.Fprintf(w, "    read -r hist_id _ <<< \"$entry\"\n")
+	fmt.Fprintf(w, "    last_cmd=$(sed -E '1s/^ *[0-9]+[* ] //' <<< \"$entry\")\n")
+	fmt.Fprintf(w, "    if [[ -n \"$last_cmd\" && \"$last_cmd\" != bashtrack* ]]; then\n")
+	fmt.Fprintf(w, "        %s record --exit-code \"$exit_code\" --history-id \"${hist_id%%\\*}\" \"$last_cmd\" 2>/dev/null\n", execPath)
+	fmt.Fprintf(w, "    fi\n")
+	fmt.Fprintf(w, "    return $exit_code\n")
+	fmt.Fprintf(w, "}\n")
 }
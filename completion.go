@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+const maxCompletions = 50
+
+// historyCompletionScript completes arguments of other commands from history.
+// It is registered for the commands given with --commands, or as the default
+// completion (complete -D) through historyDefaultScript; -o default falls back
+// to file names.
+const historyCompletionScript = `
+# History-aware argument completion from bashtrack
+_bashtrack_history_complete() {
+    local IFS=$'\n'
+    COMPREPLY=($(%[1]s complete -- "${COMP_WORDS[@]:0:$((COMP_CWORD + 1))}" 2>/dev/null))
+}
+%[2]s
+`
+
+// historyDefaultScript chains to the default completion registered before,
+// such as bash-completion's _completion_loader, so commands keep their own
+// lazily loaded completion. Commands left without one (or with only
+// bash-completion's _minimal) complete from history instead.
+const historyDefaultScript = `_bashtrack_previous=$(complete -p -D 2>/dev/null | sed -n 's/.* -F \([^ ]*\) .*/\1/p')
+if [[ $_bashtrack_previous != _bashtrack_default_complete ]]; then
+    _bashtrack_previous_default=$_bashtrack_previous
+fi
+unset _bashtrack_previous
+_bashtrack_default_complete() {
+    local cmd=${1##*/} spec status=124
+    if [[ -n $_bashtrack_previous_default ]]; then
+        "$_bashtrack_previous_default" "$@"
+        status=$?
+        spec=$(complete -p -- "$cmd" 2>/dev/null)
+        if [[ -n $spec && $spec != *" -F _minimal "* ]] || [[ -z $spec && $status -ne 124 ]]; then
+            return $status
+        fi
+    fi
+    complete -F _bashtrack_history_complete -o default -- "$cmd" && return 124
+}
+complete -D -F _bashtrack_default_complete -o default`
+
+func (app *App) generateCompletion(cmd *cobra.Command, args []string) {
+	history, _ := cmd.Flags().GetBool("history")
+	commands, _ := cmd.Flags().GetStringSlice("commands")
+
+	root := cmd.Root()
+	var err error
+	switch args[0] {
+	case "bash":
+		err = root.GenBashCompletionV2(os.Stdout, true)
+	case "zsh":
+		err = root.GenZshCompletion(os.Stdout)
+	case "fish":
+		err = root.GenFishCompletion(os.Stdout, true)
+	}
+	if err != nil {
+		ErrorLogger.Printf("Error generating completion: %v\n", err)
+		return
+	}
+
+	if history {
+		if args[0] != "bash" {
+			ErrorLogger.Println("History-aware completion is only available for bash")
+			return
+		}
+		register := historyDefaultScript
+		if len(commands) > 0 {
+			register = "complete -F _bashtrack_history_complete -o default " + strings.Join(commands, " ")
+		}
+		fmt.Printf(historyCompletionScript, appName, register)
+	}
+}
+
+// completeFromHistory prints the completions for the last of its arguments,
+// which are the words of the command line up to the cursor.
+func (app *App) completeFromHistory(_ *cobra.Command, args []string) {
+	// Flag parsing is off so words like -n reach us; drop the separator
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		return
+	}
+	candidates, err := app.historyCompletions(args[:len(args)-1], args[len(args)-1])
+	if err != nil {
+		ErrorLogger.Printf("Error completing: %v\n", err)
+		return
+	}
+	for _, c := range candidates {
+		fmt.Println(c)
+	}
+}
+
+// historyCompletions suggests the word at position len(words) of a command
+// starting with words. Arguments that followed the same program and the same
+// previous word are preferred (kubectl -n <TAB> offers namespaces); otherwise
+// any argument seen at that position for the program is offered. Candidates
+// are ranked by how often they were run.
+func (app *App) historyCompletions(words []string, prefix string) ([]string, error) {
+	if len(words) == 0 {
+		return nil, nil
+	}
+	position := len(words)
+
+	query := `
+		SELECT w.word, SUM(c.run_count) AS runs
+		FROM command_word_positions cwp
+		JOIN words w ON w.id = cwp.word_id
+		JOIN commands c ON c.id = cwp.command_id
+		WHERE cwp.position = ?
+		  AND cwp.command_id IN (
+			SELECT p.command_id FROM command_word_positions p JOIN words pw ON pw.id = p.word_id
+			WHERE p.position = 0 AND pw.word = ?)`
+	queryArgs := []interface{}{position, app.sealField(words[0])}
+
+	candidates, err := app.rankCompletions(query+`
+		  AND cwp.command_id IN (
+			SELECT p.command_id FROM command_word_positions p JOIN words pw ON pw.id = p.word_id
+			WHERE p.position = ? AND pw.word = ?)
+		GROUP BY w.word`,
+		append(queryArgs, position-1, app.sealField(words[position-1])), prefix)
+	if err != nil || len(candidates) > 0 || position == 1 {
+		return candidates, err
+	}
+
+	return app.rankCompletions(query+" GROUP BY w.word", queryArgs, prefix)
+}
+
+func (app *App) rankCompletions(query string, queryArgs []interface{}, prefix string) ([]string, error) {
+	rows, err := app.db.Query(query, queryArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type candidate struct {
+		word string
+		runs int
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.word, &c.runs); err != nil {
+			return nil, err
+		}
+		// Filter in Go so the prefix also matches encrypted words
+		c.word = app.openField(c.word)
+		if strings.HasPrefix(c.word, prefix) {
+			candidates = append(candidates, c)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].runs != candidates[j].runs {
+			return candidates[i].runs > candidates[j].runs
+		}
+		return candidates[i].word < candidates[j].word
+	})
+	if len(candidates) > maxCompletions {
+		candidates = candidates[:maxCompletions]
+	}
+
+	words := make([]string, len(candidates))
+	for i, c := range candidates {
+		words[i] = c.word
+	}
+	return words, nil
+}
+
+// completeSnippetNames completes the snippet name argument of snippet
+// subcommands.
+func (app *App) completeSnippetNames(_ *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	rows, err := app.db.Query("SELECT name FROM snippets WHERE name LIKE ? ORDER BY name", toComplete+"%")
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if rows.Scan(&name) == nil {
+			names = append(names, name)
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
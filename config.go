@@ -22,20 +22,11 @@ func loadConfig(configDir string) (*Config, error) {
 
 	// Default configuration
 	defaultConfig := &Config{
-		ExcludePatterns: []string{
-			"^ls.*",
-			"^cd.*",
-			"^pwd.*",
-			"^clear.*",
-			"^exit.*",
-			"^history.*",
-			".*password.*",
-			".*secret.*",
-			".*token.*",
-			".*key.*",
-			".*" + appName + ".*",
-		},
-		DatabasePath: filepath.Join(configDir, dbFile),
+		ExcludePatterns: defaultExcludePatterns(),
+		DatabasePath:    filepath.Join(configDir, dbFile),
+		IgnoreSpace:     true,
+		OptOutMarker:    defaultOptOutMarker,
+		Retention:       RetentionConfig{CheckEvery: defaultRetentionCheckEvery, TrashDays: defaultTrashDays},
 	}
 
 	// Try to load existing config
@@ -43,12 +34,19 @@ func loadConfig(configDir string) (*Config, error) {
 	if err != nil {
 		if os.IsNotExist(err) {
 			// Create default config
+			defaultConfig.compilePatterns()
 			return saveConfig(configPath, defaultConfig)
 		}
 		return nil, err
 	}
 
-	config := &Config{}
+	// Settings added after the first release keep their defaults when
+	// missing from older config files
+	config := &Config{
+		IgnoreSpace:  true,
+		OptOutMarker: defaultOptOutMarker,
+		Retention:    RetentionConfig{CheckEvery: defaultRetentionCheckEvery, TrashDays: defaultTrashDays},
+	}
 	if err := json.Unmarshal(data, config); err != nil {
 		return nil, fmt.Errorf("failed to parse config: %w", err)
 	}
@@ -58,9 +56,32 @@ func loadConfig(configDir string) (*Config, error) {
 		config.DatabasePath = filepath.Join(configDir, dbFile)
 	}
 
+	// Invalid patterns are skipped rather than failing every record call
+	if err := config.compilePatterns(); err != nil {
+		ErrorLogger.Printf("Warning: %v\n", err)
+	}
+
 	return config, nil
 }
 
+const defaultOptOutMarker = "#nobt"
+
+func defaultExcludePatterns() []string {
+	return []string{
+		"^ls.*",
+		"^cd.*",
+		"^pwd.*",
+		"^clear.*",
+		"^exit.*",
+		"^history.*",
+		".*password.*",
+		".*secret.*",
+		".*token.*",
+		".*key.*",
+		".*" + appName + ".*",
+	}
+}
+
 func saveConfig(configPath string, config *Config) (*Config, error) {
 	data, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
@@ -87,3 +108,13 @@ func loadConfigFromPath(configPath string) (*Config, error) {
 
 	return config, nil
 }
+
+// persistConfig writes the in-memory configuration back to the config file.
+func (app *App) persistConfig() error {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return err
+	}
+	_, err = saveConfig(filepath.Join(configDir, configFile), app.config)
+	return err
+}
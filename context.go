@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// commandRun is one execution of a recorded command. Session is empty for
+// runs recorded before sessions were tracked or merged from other hosts.
+type commandRun struct {
+	id        int64
+	commandID int
+	session   string
+	timestamp time.Time
+	directory string
+	command   string
+	// exitCode is only known for runs recorded with record --exit-code
+	exitCode sql.NullInt64
+	// historyID is the shell history number passed with record --history-id
+	historyID sql.NullInt64
+}
+
+// insertRun records a run and, within a session, the transition from the
+// previous command that suggest learns from.
+func (app *App) insertRun(tx *sql.Tx, commandID int64, run commandRun) error {
+	directory := app.sealField(run.directory)
+
+	var session interface{}
+	if run.session != "" {
+		session = run.session
+
+		var prevID int64
+		err := tx.QueryRow("SELECT command_id FROM runs WHERE session = ? ORDER BY id DESC LIMIT 1", run.session).Scan(&prevID)
+		if err == nil {
+			_, err = tx.Exec(`
+				INSERT INTO transitions (prev_id, next_id, directory, count, last_seen) VALUES (?, ?, ?, 1, ?)
+				ON CONFLICT(prev_id, next_id, directory) DO UPDATE SET
+					count = count + 1, last_seen = excluded.last_seen`,
+				prevID, commandID, directory, run.timestamp,
+			)
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("recording transition: %w", err)
+		}
+	}
+
+	_, err := tx.Exec(
+		"INSERT INTO runs (command_id, session, timestamp, directory, exit_code, history_id) VALUES (?, ?, ?, ?, ?, ?)",
+		commandID, session, run.timestamp, directory, run.exitCode, run.historyID,
+	)
+	return err
+}
+
+// isRerecord reports whether run repeats the session's last recorded run of
+// command under the same shell history number. The prompt hook sends the last
+// history entry again when Enter is pressed on an empty line; comparing the
+// command too keeps HISTCONTROL=erasedups, which renumbers entries, safe.
+func (app *App) isRerecord(run commandRun, command string) (bool, error) {
+	if !run.historyID.Valid || run.session == "" {
+		return false, nil
+	}
+	var historyID sql.NullInt64
+	var lastCommand string
+	err := app.db.QueryRow(`
+		SELECT r.history_id, c.full_command
+		FROM runs r JOIN commands c ON c.id = r.command_id
+		WHERE r.session = ? ORDER BY r.id DESC LIMIT 1`, run.session).Scan(&historyID, &lastCommand)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return historyID == run.historyID && app.openField(lastCommand) == command, nil
+}
+
+func (app *App) showContext(cmd *cobra.Command, args []string) {
+	n, _ := cmd.Flags().GetInt("number")
+
+	id, err := app.parseCommandID(args[0])
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
+
+	out, err := rendererFromFlags(cmd)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
+
+	before, target, after, err := app.runContext(id, n)
+	if err != nil {
+		ErrorLogger.Printf("Error loading context: %v\n", err)
+		return
+	}
+
+	if !out.text() {
+		var entries contextList
+		for _, run := range before {
+			entries = append(entries, run.contextEntry(false))
+		}
+		entries = append(entries, target.contextEntry(true))
+		for _, run := range after {
+			entries = append(entries, run.contextEntry(false))
+		}
+		if err := out.render(entries); err != nil {
+			ErrorLogger.Printf("Error writing output: %v\n", err)
+		}
+		return
+	}
+
+	if target.session != "" {
+		fmt.Printf("Context of command %d in session %s:\n", id, target.session)
+	} else {
+		fmt.Printf("Context of command %d in %s:\n", id, target.directory)
+	}
+	fmt.Println(strings.Repeat("-", 80))
+
+	for _, run := range before {
+		printRun(run, "  ")
+	}
+	printRun(target, "> ")
+	for _, run := range after {
+		printRun(run, "  ")
+	}
+}
+
+func printRun(run commandRun, marker string) {
+	fmt.Printf("%s[%d] %s  %s\n", marker, run.commandID, run.timestamp.Format("2006-01-02 15:04:05"), run.command)
+}
+
+// contextEntry is a run as listed by context. Target marks the run of the
+// requested command.
+type contextEntry struct {
+	ID        int       `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Directory string    `json:"directory"`
+	Session   string    `json:"session,omitempty"`
+	Command   string    `json:"command"`
+	Target    bool      `json:"target"`
+}
+
+func (run commandRun) contextEntry(target bool) contextEntry {
+	return contextEntry{
+		ID:        run.commandID,
+		Timestamp: run.timestamp,
+		Directory: run.directory,
+		Session:   run.session,
+		Command:   run.command,
+		Target:    target,
+	}
+}
+
+// runContext returns up to n runs before and after the latest run of a
+// command, in order. Runs are grouped by shell session, or by directory when
+// the run has no session.
+func (app *App) runContext(commandID, n int) (before []commandRun, target commandRun, after []commandRun, err error) {
+	var session sql.NullString
+	err = app.db.QueryRow(`
+		SELECT r.id, r.command_id, r.session, r.timestamp, r.directory, c.full_command
+		FROM runs r JOIN commands c ON c.id = r.command_id
+		WHERE r.command_id = ? ORDER BY r.timestamp DESC, r.id DESC LIMIT 1`, commandID).
+		Scan(&target.id, &target.commandID, &session, &target.timestamp, &target.directory, &target.command)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, target, nil, fmt.Errorf("no runs recorded for command %d", commandID)
+	}
+	if err != nil {
+		return nil, target, nil, err
+	}
+	target.session = session.String
+
+	// Directories compare equal in their stored form, even when encrypted
+	group, value := "directory", target.directory
+	if session.Valid {
+		group, value = "session", session.String
+	}
+	target.directory = app.openField(target.directory)
+	target.command = app.openField(target.command)
+
+	before, err = app.neighbourRuns(group, value, "<", "DESC", target.id, n)
+	if err != nil {
+		return nil, target, nil, err
+	}
+	// Fetched nearest first; show them in order
+	for i, j := 0, len(before)-1; i < j; i, j = i+1, j-1 {
+		before[i], before[j] = before[j], before[i]
+	}
+
+	after, err = app.neighbourRuns(group, value, ">", "ASC", target.id, n)
+	return before, target, after, err
+}
+
+// neighbourRuns returns up to n runs in the group before (comparison "<") or
+// after (">") the given run, nearest first. Runs are ordered by time, since
+// runs merged by sync or restored from the trash get newer IDs than their
+// neighbours.
+func (app *App) neighbourRuns(group, value, comparison, order string, runID int64, n int) ([]commandRun, error) {
+	rows, err := app.db.Query(`
+		SELECT r.id, r.command_id, COALESCE(r.session, ''), r.timestamp, r.directory, c.full_command
+		FROM runs r JOIN commands c ON c.id = r.command_id
+		WHERE r.`+group+` = ? AND (r.timestamp, r.id) `+comparison+` (SELECT timestamp, id FROM runs WHERE id = ?)
+		ORDER BY r.timestamp `+order+`, r.id `+order+` LIMIT ?`,
+		value, runID, n,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []commandRun
+	for rows.Next() {
+		var run commandRun
+		if err := rows.Scan(&run.id, &run.commandID, &run.session, &run.timestamp, &run.directory, &run.command); err != nil {
+			return nil, err
+		}
+		run.directory = app.openField(run.directory)
+		run.command = app.openField(run.command)
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
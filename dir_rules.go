@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const ignoreFile = "." + appName + "ignore"
+
+// includeOnlyRule is the rule recorded for exclusions made because no include
+// directory rule matched in include-only mode.
+const includeOnlyRule = "include-only"
+
+// dirRule is one entry of Config.DirectoryRules. The syntax mirrors the
+// command rules: a leading "!" marks an include rule and the first matching
+// rule wins. A pattern without glob characters matches that directory and
+// everything below it; a glob pattern matches the directory or any of its
+// ancestors.
+type dirRule struct {
+	source  string
+	pattern string
+	include bool
+	glob    bool
+}
+
+func parseDirRule(source string) (dirRule, error) {
+	rule := dirRule{source: source, pattern: source}
+	switch {
+	case strings.HasPrefix(source, "!"):
+		rule.include = true
+		rule.pattern = source[1:]
+	case strings.HasPrefix(source, `\!`):
+		rule.pattern = source[1:]
+	}
+
+	pattern, err := expandHome(rule.pattern)
+	if err != nil {
+		return rule, err
+	}
+	rule.pattern = filepath.Clean(pattern)
+	rule.glob = strings.ContainsAny(rule.pattern, "*?[")
+
+	if rule.glob {
+		if _, err := filepath.Match(rule.pattern, ""); err != nil {
+			return rule, fmt.Errorf("invalid directory pattern %q: %w", source, err)
+		}
+	}
+	return rule, nil
+}
+
+func (r dirRule) action() string {
+	if r.include {
+		return "include"
+	}
+	return "exclude"
+}
+
+func (r dirRule) matches(dir string) bool {
+	if !r.glob {
+		return isWithin(dir, r.pattern)
+	}
+	for d := dir; ; d = filepath.Dir(d) {
+		if matched, _ := filepath.Match(r.pattern, d); matched {
+			return true
+		}
+		if parent := filepath.Dir(d); parent == d {
+			return false
+		}
+	}
+}
+
+// isWithin reports whether dir is root or one of its subdirectories.
+func isWithin(dir, root string) bool {
+	dir, root = filepath.Clean(dir), filepath.Clean(root)
+	sep := string(filepath.Separator)
+	return dir == root || strings.HasPrefix(dir, strings.TrimSuffix(root, sep)+sep)
+}
+
+// expandHome replaces a leading "~" with the user's home directory.
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, path[1:]), nil
+}
+
+func (c *Config) compileDirRules() error {
+	c.dirRules = make([]dirRule, 0, len(c.DirectoryRules))
+	var errs []error
+	for _, source := range c.DirectoryRules {
+		rule, err := parseDirRule(source)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("ignoring directory rule: %w", err))
+			continue
+		}
+		c.dirRules = append(c.dirRules, rule)
+	}
+	return errors.Join(errs...)
+}
+
+// matchDirRule returns the first directory rule matching dir.
+func (app *App) matchDirRule(dir string) (dirRule, bool) {
+	if app.config.dirRules == nil {
+		app.config.compileDirRules()
+	}
+	for _, rule := range app.config.dirRules {
+		if rule.matches(dir) {
+			return rule, true
+		}
+	}
+	return dirRule{}, false
+}
+
+// ignoreFileRules describes the nearest .bashtrackignore above a directory.
+// A file without rules ignores the whole tree; otherwise its lines are
+// command rules checked before the configured ones.
+type ignoreFileRules struct {
+	path  string
+	rules []filterRule
+}
+
+// findIgnoreFile walks up from dir and loads the first .bashtrackignore found.
+func findIgnoreFile(dir string) (*ignoreFileRules, error) {
+	for d := dir; ; d = filepath.Dir(d) {
+		path := filepath.Join(d, ignoreFile)
+		if _, err := os.Stat(path); err == nil {
+			return loadIgnoreFile(path)
+		}
+		if parent := filepath.Dir(d); parent == d {
+			return nil, nil
+		}
+	}
+}
+
+func loadIgnoreFile(path string) (*ignoreFileRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ignore := &ignoreFileRules{path: path}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		ignore.rules = append(ignore.rules, rule)
+	}
+	return ignore, scanner.Err()
+}
+
+// exclusion describes the rule that kept a command out of the database.
+type exclusion struct {
+	kind string // "rule", "directory" or "ignore-file"
+	rule string // rule source, or the ignore file path for a bare ignore file
+	file string // ignore file the rule came from, if any
+}
+
+func (e *exclusion) String() string {
+	switch {
+	case e.kind == "directory" && e.rule == includeOnlyRule:
+		return "include-only mode (no include directory rule matches)"
+	case e.kind == "directory":
+		return "directory rule " + e.rule
+	case e.kind == "ignore-file" && e.file == "":
+		return "ignore file " + e.rule
+	case e.file != "":
+		return "rule " + e.rule + " in " + e.file
+	default:
+		return "rule " + e.rule
+	}
+}
+
+// exclusionReason reports why command run in dir should not be recorded, or
+// nil if it should be recorded. Directory rules are checked first, then the
+// nearest .bashtrackignore, then the command rules. In include-only mode a
+// directory no include rule matches is excluded.
+func (app *App) exclusionReason(command, dir string) *exclusion {
+	if filepath.IsAbs(dir) {
+		// An include rule only shields the directory from later directory
+		// rules; a more specific .bashtrackignore still applies
+		rule, matched := app.matchDirRule(dir)
+		if matched && !rule.include {
+			return &exclusion{kind: "directory", rule: rule.source}
+		}
+		if !matched && app.config.DirectoryIncludeOnly {
+			return &exclusion{kind: "directory", rule: includeOnlyRule}
+		}
+
+		ignore, err := findIgnoreFile(dir)
+		if err != nil {
+			// Err on the side of privacy when an ignore file can't be used
+			ErrorLogger.Printf("Warning: %v\n", err)
+			return &exclusion{kind: "ignore-file", rule: "unreadable"}
+		}
+		if ignore != nil {
+			if len(ignore.rules) == 0 {
+				return &exclusion{kind: "ignore-file", rule: ignore.path}
+			}
+			return app.commandExclusionReason(command, ignore)
+		}
+	}
+	return app.commandExclusionReason(command, nil)
+}
+
+func (app *App) commandExclusionReason(command string, ignore *ignoreFileRules) *exclusion {
+	if ignore != nil {
+		for _, rule := range ignore.rules {
+			if rule.re.MatchString(command) {
+				if rule.include {
+					return nil
+				}
+				return &exclusion{kind: "ignore-file", rule: rule.source, file: ignore.path}
+			}
+		}
+	}
+	if rule, matched := app.matchRule(command); matched && !rule.include {
+		return &exclusion{kind: "rule", rule: rule.source}
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// doctorReport collects the findings of a database health check.
+type doctorReport struct {
+	Integrity      []string
+	ForeignKeys    []foreignKeyViolation
+	OrphanWords    int
+	OrphanPosition int
+	StaleCommands  []int
+}
+
+// foreignKeyViolation is a row whose parent row no longer exists, such as a
+// run of a deleted command.
+type foreignKeyViolation struct {
+	Table string
+	RowID int64
+}
+
+func (r *doctorReport) healthy() bool {
+	return len(r.Integrity) == 1 && r.Integrity[0] == "ok" &&
+		len(r.ForeignKeys) == 0 && r.OrphanWords == 0 && r.OrphanPosition == 0 && len(r.StaleCommands) == 0
+}
+
+func (app *App) runDoctor(cmd *cobra.Command, _ []string) {
+	fix, _ := cmd.Flags().GetBool("fix")
+
+	fmt.Println("Database Health Check")
+	fmt.Println(strings.Repeat("=", 40))
+	app.printStorageSizes()
+
+	report, err := app.checkDatabase()
+	if err != nil {
+		ErrorLogger.Printf("Error checking database: %v\n", err)
+		return
+	}
+
+	fmt.Println()
+	fmt.Printf("Integrity check: %s\n", strings.Join(report.Integrity, "; "))
+	fmt.Printf("Foreign key violations: %d\n", len(report.ForeignKeys))
+	fmt.Printf("Orphaned words: %d\n", report.OrphanWords)
+	fmt.Printf("Orphaned word positions: %d\n", report.OrphanPosition)
+	fmt.Printf("Commands with stale word links: %d\n", len(report.StaleCommands))
+
+	if report.healthy() {
+		fmt.Println("\nNo problems found.")
+		return
+	}
+	if !fix {
+		fmt.Println("\nRun 'bashtrack doctor --fix' to repair.")
+		return
+	}
+
+	if err := app.repairDatabase(report); err != nil {
+		ErrorLogger.Printf("Error repairing database: %v\n", err)
+		return
+	}
+
+	report, err = app.checkDatabase()
+	if err != nil {
+		ErrorLogger.Printf("Error re-checking database: %v\n", err)
+		return
+	}
+	if !report.healthy() {
+		fmt.Println("\nSome problems remain after repair; consider restoring from a backup.")
+		return
+	}
+	fmt.Println("\nRepairs completed.")
+}
+
+func (app *App) checkDatabase() (*doctorReport, error) {
+	report := &doctorReport{}
+
+	rows, err := app.db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return nil, fmt.Errorf("integrity check: %w", err)
+	}
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		report.Integrity = append(report.Integrity, line)
+	}
+	rows.Close()
+
+	rows, err = app.db.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return nil, fmt.Errorf("foreign key check: %w", err)
+	}
+	for rows.Next() {
+		// Columns: table, rowid, parent table, foreign key index
+		var v foreignKeyViolation
+		var rowID sql.NullInt64
+		var parent string
+		var fkid int
+		if err := rows.Scan(&v.Table, &rowID, &parent, &fkid); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		v.RowID = rowID.Int64
+		report.ForeignKeys = append(report.ForeignKeys, v)
+	}
+	rows.Close()
+
+	err = app.db.QueryRow("SELECT COUNT(*) FROM words WHERE id NOT IN (SELECT word_id FROM command_word_positions)").
+		Scan(&report.OrphanWords)
+	if err != nil {
+		return nil, fmt.Errorf("counting orphaned words: %w", err)
+	}
+
+	err = app.db.QueryRow(`
+		SELECT COUNT(*) FROM command_word_positions
+		WHERE command_id NOT IN (SELECT id FROM commands)
+		   OR word_id NOT IN (SELECT id FROM words)`).Scan(&report.OrphanPosition)
+	if err != nil {
+		return nil, fmt.Errorf("counting orphaned word positions: %w", err)
+	}
+
+	report.StaleCommands, err = app.findStaleWordLinks()
+	if err != nil {
+		return nil, fmt.Errorf("checking word links: %w", err)
+	}
+	return report, nil
+}
+
+// findStaleWordLinks returns the commands whose linked words don't match the
+// words of their full_command. With encryption enabled the words are compared
+// in their encrypted form, which is deterministic.
+func (app *App) findStaleWordLinks() ([]int, error) {
+	rows, err := app.db.Query(`
+		SELECT c.id, c.full_command, COALESCE(GROUP_CONCAT(w.word, ' ' ORDER BY cwp.position), '')
+		FROM commands c
+		LEFT JOIN command_word_positions cwp ON cwp.command_id = c.id
+		LEFT JOIN words w ON w.id = cwp.word_id
+		GROUP BY c.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stale []int
+	for rows.Next() {
+		var id int
+		var command, linked string
+		if err := rows.Scan(&id, &command, &linked); err != nil {
+			return nil, err
+		}
+		words := strings.Fields(app.openField(command))
+		for i, word := range words {
+			words[i] = app.sealField(word)
+		}
+		if strings.Join(words, " ") != linked {
+			stale = append(stale, id)
+		}
+	}
+	return stale, rows.Err()
+}
+
+func (app *App) repairDatabase(report *doctorReport) error {
+	if len(report.Integrity) != 1 || report.Integrity[0] != "ok" {
+		// Rebuilding indexes fixes the most common kind of corruption
+		if _, err := app.db.Exec("REINDEX"); err != nil {
+			return fmt.Errorf("reindexing: %w", err)
+		}
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Safe to call even after commit
+
+	// Rows pointing at a deleted command or trash entry have nothing left to
+	// describe, so they go rather than being re-parented
+	for _, v := range report.ForeignKeys {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %q WHERE rowid = ?", v.Table), v.RowID); err != nil {
+			return fmt.Errorf("deleting orphaned %s row %d: %w", v.Table, v.RowID, err)
+		}
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM command_word_positions
+		WHERE command_id NOT IN (SELECT id FROM commands)
+		   OR word_id NOT IN (SELECT id FROM words)`)
+	if err != nil {
+		return fmt.Errorf("deleting orphaned word positions: %w", err)
+	}
+
+	for _, id := range report.StaleCommands {
+		if err := app.rebuildWordLinks(tx, id); err != nil {
+			return fmt.Errorf("rebuilding word links for command %d: %w", id, err)
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM words WHERE id NOT IN (SELECT word_id FROM command_word_positions)"); err != nil {
+		return fmt.Errorf("deleting orphaned words: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// rebuildWordLinks replaces the word links of a command with ones derived
+// from its full_command.
+func (app *App) rebuildWordLinks(tx *sql.Tx, commandID int) error {
+	var command string
+	if err := tx.QueryRow("SELECT full_command FROM commands WHERE id = ?", commandID).Scan(&command); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM command_word_positions WHERE command_id = ?", commandID); err != nil {
+		return err
+	}
+	return app.insertCommandWords(tx, int64(commandID), strings.Fields(app.openField(command)))
+}
+
+func (app *App) printStorageSizes() {
+	path := app.config.DatabasePath
+	fmt.Printf("Database: %s\n", path)
+	for _, f := range []struct{ label, path string }{
+		{"Database file", path},
+		{"WAL file", path + "-wal"},
+		{"Shared memory file", path + "-shm"},
+	} {
+		size := "missing"
+		if info, err := os.Stat(f.path); err == nil {
+			size = formatBytes(info.Size())
+		}
+		fmt.Printf("  %s: %s\n", f.label, size)
+	}
+
+	var pageSize, freePages int64
+	app.db.QueryRow("PRAGMA page_size").Scan(&pageSize)
+	app.db.QueryRow("PRAGMA freelist_count").Scan(&freePages)
+	fmt.Printf("  Free space: %s (%d pages)\n", formatBytes(pageSize*freePages), freePages)
+
+	sizes, exact, err := app.indexSizes()
+	if err != nil {
+		fmt.Printf("  Index sizes: unavailable (%v)\n", err)
+		return
+	}
+	if exact {
+		fmt.Println("  Index sizes:")
+	} else {
+		fmt.Println("  Index sizes (estimated):")
+	}
+	for _, s := range sizes {
+		fmt.Printf("    %s: %s\n", s.name, formatBytes(s.size))
+	}
+}
+
+type indexSize struct {
+	name string
+	size int64
+}
+
+// indexSizes reports the on-disk size of each index using the dbstat virtual
+// table. SQLite builds without dbstat fall back to an estimate from the
+// indexed column lengths.
+func (app *App) indexSizes() ([]indexSize, bool, error) {
+	rows, err := app.db.Query(`
+		SELECT s.name, SUM(s.pgsize)
+		FROM dbstat s JOIN sqlite_master m ON m.name = s.name
+		WHERE m.type = 'index'
+		GROUP BY s.name ORDER BY s.name`)
+	if err == nil {
+		defer rows.Close()
+		var sizes []indexSize
+		for rows.Next() {
+			var s indexSize
+			if err := rows.Scan(&s.name, &s.size); err != nil {
+				return nil, true, err
+			}
+			sizes = append(sizes, s)
+		}
+		return sizes, true, rows.Err()
+	}
+
+	indexRows, err := app.db.Query("SELECT name, tbl_name FROM sqlite_master WHERE type = 'index' ORDER BY name")
+	if err != nil {
+		return nil, false, err
+	}
+	type index struct{ name, table string }
+	var indexes []index
+	for indexRows.Next() {
+		var i index
+		if err := indexRows.Scan(&i.name, &i.table); err != nil {
+			indexRows.Close()
+			return nil, false, err
+		}
+		indexes = append(indexes, i)
+	}
+	indexRows.Close()
+
+	var sizes []indexSize
+	for _, i := range indexes {
+		columns, err := app.indexColumns(i.name)
+		if err != nil || len(columns) == 0 {
+			continue
+		}
+		// Each entry stores the key columns plus the rowid and a few bytes of
+		// cell overhead
+		var lengths []string
+		for _, c := range columns {
+			lengths = append(lengths, fmt.Sprintf("COALESCE(LENGTH(CAST(%q AS BLOB)), 0)", c))
+		}
+		var size sql.NullInt64
+		query := fmt.Sprintf("SELECT SUM(%s + 12) FROM %q", strings.Join(lengths, " + "), i.table)
+		if err := app.db.QueryRow(query).Scan(&size); err != nil {
+			continue
+		}
+		sizes = append(sizes, indexSize{name: i.name, size: size.Int64})
+	}
+	return sizes, false, nil
+}
+
+func (app *App) indexColumns(index string) ([]string, error) {
+	rows, err := app.db.Query("SELECT name FROM pragma_index_info(?)", index)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var name sql.NullString
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if name.Valid {
+			columns = append(columns, name.String)
+		}
+	}
+	return columns, rows.Err()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
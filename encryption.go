@@ -0,0 +1,413 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	encryptedPrefix = "enc:"
+	passphraseEnv   = "BASHTRACK_PASSPHRASE"
+	keyFileName     = "key"
+	encryptionCheck = appName
+)
+
+// EncryptionConfig enables encryption of commands and directories at rest.
+type EncryptionConfig struct {
+	Enabled bool `json:"enabled"`
+	// KeyFile holds a random key; without one the key is derived from
+	// $BASHTRACK_PASSPHRASE and a salt stored in the database
+	KeyFile string `json:"key_file,omitempty"`
+}
+
+// fieldCipher encrypts individual column values. Encryption is deterministic:
+// the nonce is an HMAC of the plaintext, so equal values give equal
+// ciphertexts. The ciphertext therefore doubles as a blind index, which keeps
+// deduplication, GROUP BY and exact word lookups working on encrypted data
+// while revealing nothing beyond which values are equal.
+type fieldCipher struct {
+	aead     cipher.AEAD
+	indexKey []byte
+}
+
+func newFieldCipher(masterKey []byte) (*fieldCipher, error) {
+	aead, err := newGCM(hmacSum(masterKey, appName+" encryption"))
+	if err != nil {
+		return nil, err
+	}
+	return &fieldCipher{aead: aead, indexKey: hmacSum(masterKey, appName+" index")}, nil
+}
+
+func hmacSum(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (c *fieldCipher) seal(plaintext string) string {
+	nonce := hmacSum(c.indexKey, plaintext)[:c.aead.NonceSize()]
+	sealed := c.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encryptedPrefix + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+func (c *fieldCipher) open(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil {
+		return "", err
+	}
+	if len(data) < c.aead.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	plaintext, err := c.aead.Open(nil, data[:c.aead.NonceSize()], data[c.aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("decryption failed: wrong key or corrupted data")
+	}
+	return string(plaintext), nil
+}
+
+// sealField encrypts a value for storage when encryption is enabled.
+func (app *App) sealField(value string) string {
+	if app.cipher == nil {
+		return value
+	}
+	return app.cipher.seal(value)
+}
+
+// openField decrypts a stored value. Values written before encryption was
+// enabled, or when it is disabled, are returned unchanged.
+func (app *App) openField(value string) string {
+	if app.cipher == nil {
+		return value
+	}
+	plaintext, err := app.cipher.open(value)
+	if err != nil {
+		return value
+	}
+	return plaintext
+}
+
+// openCommand decrypts the text fields of c in place.
+func (app *App) openCommand(c *Command) {
+	c.Command = app.openField(c.Command)
+	c.Directory = app.openField(c.Directory)
+	c.Host = app.openField(c.Host)
+}
+
+func getSetting(db *sql.DB, key string) (string, bool, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	return value, err == nil, err
+}
+
+func setSetting(db execer, key, value string) error {
+	_, err := db.Exec(`
+		INSERT INTO settings (key, value) VALUES (?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`,
+		key, value,
+	)
+	return err
+}
+
+// loadMasterKey reads the key file, or derives the key from the passphrase
+// and the salt stored in the database. With create set, a missing key file
+// or salt is generated.
+func loadMasterKey(cfg EncryptionConfig, db *sql.DB, create bool) ([]byte, error) {
+	if cfg.KeyFile != "" {
+		path, err := expandHome(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) && create {
+			key := make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				return nil, err
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				return nil, err
+			}
+			encoded := base64.StdEncoding.EncodeToString(key)
+			if err := os.WriteFile(path, []byte(encoded+"\n"), 0600); err != nil {
+				return nil, err
+			}
+			return key, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("key file %s does not contain a base64 encoded 256-bit key", path)
+		}
+		return key, nil
+	}
+
+	passphrase := os.Getenv(passphraseEnv)
+	if passphrase == "" {
+		return nil, fmt.Errorf("no key file configured and %s is not set", passphraseEnv)
+	}
+	salt, found, err := getSetting(db, "encryption_salt")
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		if !create {
+			return nil, errors.New("database has no encryption salt")
+		}
+		raw, err := newSalt()
+		if err != nil {
+			return nil, err
+		}
+		salt = base64.StdEncoding.EncodeToString(raw)
+		if err := setSetting(db, "encryption_salt", salt); err != nil {
+			return nil, err
+		}
+	}
+	return deriveKey(passphrase, []byte(salt)), nil
+}
+
+// loadFieldCipher returns the cipher for an encrypted database and checks it
+// against the value stored when encryption was enabled, so a wrong key fails
+// loudly instead of producing garbage.
+func loadFieldCipher(cfg EncryptionConfig, db *sql.DB) (*fieldCipher, error) {
+	key, err := loadMasterKey(cfg, db, false)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newFieldCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	check, found, err := getSetting(db, "encryption_check")
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		if plaintext, err := c.open(check); err != nil || plaintext != encryptionCheck {
+			return nil, errors.New("encryption key does not match the database")
+		}
+	}
+	return c, nil
+}
+
+func (app *App) enableEncryption(cmd *cobra.Command, _ []string) {
+	usePassphrase, _ := cmd.Flags().GetBool("passphrase")
+	keyFile, _ := cmd.Flags().GetString("key-file")
+
+	// Without the check value the config was saved but encrypting the
+	// database never finished, so enabling again completes it
+	if app.config.Encryption.Enabled {
+		if _, found, err := getSetting(app.db, "encryption_check"); err != nil || found {
+			fmt.Println("Encryption is already enabled")
+			return
+		}
+	}
+
+	cfg := EncryptionConfig{Enabled: true}
+	if !usePassphrase {
+		if keyFile == "" {
+			keyFile = filepath.Join(filepath.Dir(app.config.DatabasePath), keyFileName)
+		}
+		cfg.KeyFile = keyFile
+	}
+
+	// Save the config first: a database encrypted without the config saying
+	// so could not be read, while a failed encryption just restores it
+	previous := app.config.Encryption
+	app.config.Encryption = cfg
+	if err := app.persistConfig(); err != nil {
+		app.config.Encryption = previous
+		ErrorLogger.Printf("Error saving config: %v\n", err)
+		return
+	}
+
+	if err := app.encryptDatabase(cfg); err != nil {
+		ErrorLogger.Printf("Error encrypting database: %v\n", err)
+		app.config.Encryption = previous
+		if err := app.persistConfig(); err != nil {
+			ErrorLogger.Printf("Error restoring config: %v\n", err)
+		}
+		return
+	}
+
+	// Make sure no plaintext is left in free pages or the WAL
+	if err := app.scrubFreePages(); err != nil {
+		ErrorLogger.Printf("Warning: %v\n", err)
+	}
+
+	fmt.Println("Encryption enabled")
+	if cfg.KeyFile != "" {
+		fmt.Printf("Key stored in %s; keep a copy somewhere safe, without it the history can't be read\n", cfg.KeyFile)
+	} else {
+		fmt.Printf("Key derived from %s; it must be set whenever %s runs\n", passphraseEnv, appName)
+	}
+}
+
+func (app *App) disableEncryption(_ *cobra.Command, _ []string) {
+	if !app.config.Encryption.Enabled || app.cipher == nil {
+		fmt.Println("Encryption is not enabled")
+		return
+	}
+
+	previous := app.config.Encryption
+	app.config.Encryption = EncryptionConfig{}
+	if err := app.persistConfig(); err != nil {
+		app.config.Encryption = previous
+		ErrorLogger.Printf("Error saving config: %v\n", err)
+		return
+	}
+
+	if err := app.decryptDatabase(); err != nil {
+		ErrorLogger.Printf("Error decrypting database: %v\n", err)
+		app.config.Encryption = previous
+		if err := app.persistConfig(); err != nil {
+			ErrorLogger.Printf("Error restoring config: %v\n", err)
+		}
+		return
+	}
+
+	fmt.Println("Encryption disabled")
+}
+
+func (app *App) showEncryptionStatus(_ *cobra.Command, _ []string) {
+	cfg := app.config.Encryption
+	switch {
+	case !cfg.Enabled:
+		fmt.Println("Encryption: disabled")
+	case cfg.KeyFile != "":
+		fmt.Printf("Encryption: enabled (key file %s)\n", cfg.KeyFile)
+	default:
+		fmt.Printf("Encryption: enabled (passphrase from %s)\n", passphraseEnv)
+	}
+}
+
+// encryptDatabase encrypts all existing commands, directories and words with
+// the key described by cfg and makes the app encrypt from then on.
+func (app *App) encryptDatabase(cfg EncryptionConfig) error {
+	key, err := loadMasterKey(cfg, app.db, true)
+	if err != nil {
+		return fmt.Errorf("loading key: %w", err)
+	}
+	c, err := newFieldCipher(key)
+	if err != nil {
+		return err
+	}
+
+	// Values already sealed were recorded after an interrupted enable
+	seal := func(value string) string {
+		if strings.HasPrefix(value, encryptedPrefix) {
+			return value
+		}
+		return c.seal(value)
+	}
+	err = app.rewriteFields(seal, func(tx *sql.Tx) error {
+		return setSetting(tx, "encryption_check", c.seal(encryptionCheck))
+	})
+	if err != nil {
+		return err
+	}
+	app.cipher = c
+	return nil
+}
+
+// decryptDatabase reverses encryptDatabase.
+func (app *App) decryptDatabase() error {
+	err := app.rewriteFields(app.openField, func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM settings WHERE key IN ('encryption_check', 'encryption_salt')")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	app.cipher = nil
+	return nil
+}
+
+// rewriteFields passes every command, directory, word, tag, note and snippet,
+// including trashed commands and their annotations, through transform
+// in one transaction, e.g. to encrypt or decrypt an existing database.
+func (app *App) rewriteFields(transform func(string) string, finish func(tx *sql.Tx) error) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Safe to call even after commit
+
+	for _, column := range []struct{ table, column string }{
+		{"commands", "full_command"},
+		{"commands", "directory"},
+		{"words", "word"},
+		{"trash", "full_command"},
+		{"trash", "directory"},
+		{"tags", "tag"},
+		{"notes", "note"},
+		{"trash_tags", "tag"},
+		{"trash_notes", "note"},
+		{"snippets", "template"},
+		{"snippets", "description"},
+		{"snippets", "params"},
+		{"runs", "directory"},
+		{"transitions", "directory"},
+	} {
+		if err := rewriteColumn(tx, column.table, column.column, transform); err != nil {
+			return fmt.Errorf("rewriting %s.%s: %w", column.table, column.column, err)
+		}
+	}
+
+	if err := finish(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func rewriteColumn(tx *sql.Tx, table, column string, transform func(string) string) error {
+	rows, err := tx.Query(fmt.Sprintf("SELECT rowid, %s FROM %s", column, table))
+	if err != nil {
+		return err
+	}
+	type row struct {
+		id    int
+		value string
+	}
+	var updates []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.value); err != nil {
+			rows.Close()
+			return err
+		}
+		if transformed := transform(r.value); transformed != r.value {
+			updates = append(updates, row{r.id, transformed})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	update := fmt.Sprintf("UPDATE %s SET %s = ? WHERE rowid = ?", table, column)
+	for _, r := range updates {
+		if _, err := tx.Exec(update, r.value, r.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// filterRule is one entry of the ordered rule list stored in
+// Config.ExcludePatterns. Like gitignore, a leading "!" turns the rule into an
+// include rule and "\!" escapes a literal "!". Unlike gitignore, the first
+// matching rule decides, so includes must come before the excludes they
+// override.
+type filterRule struct {
+	source  string
+	pattern string
+	include bool
+	re      *regexp.Regexp
+}
+
+func (r filterRule) action() string {
+	if r.include {
+		return "include"
+	}
+	return "exclude"
+}
+
+func parseRule(source string) (filterRule, error) {
+	rule := filterRule{source: source, pattern: source}
+	switch {
+	case strings.HasPrefix(source, "!"):
+		rule.include = true
+		rule.pattern = source[1:]
+	case strings.HasPrefix(source, `\!`):
+		rule.pattern = source[1:]
+	}
+
+	if err := validateExcludePattern(rule.pattern); err != nil {
+		return rule, err
+	}
+	rule.re = regexp.MustCompile(rule.pattern)
+	return rule, nil
+}
+
+// excludeRuleSource returns the rule list entry that excludes pattern.
+func excludeRuleSource(pattern string) string {
+	if strings.HasPrefix(pattern, "!") {
+		return `\` + pattern
+	}
+	return pattern
+}
+
+// includeRuleSource returns the rule list entry that includes pattern.
+func includeRuleSource(pattern string) string {
+	return "!" + pattern
+}
+
+// insertRule inserts source at the 1-based position, or appends it when
+// position is out of range.
+func insertRule(rules []string, source string, position int) []string {
+	if position < 1 || position > len(rules) {
+		return append(rules, source)
+	}
+	rules = append(rules, "")
+	copy(rules[position:], rules[position-1:])
+	rules[position-1] = source
+	return rules
+}
+
+// compilePatterns compiles the rule list so matching does not recompile a
+// regex for every recorded command. Invalid rules are left out and reported
+// together in the returned error.
+func (c *Config) compilePatterns() error {
+	c.rules = make([]filterRule, 0, len(c.ExcludePatterns))
+	var errs []error
+	for _, source := range c.ExcludePatterns {
+		rule, err := parseRule(source)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("ignoring rule: %w", err))
+			continue
+		}
+		c.rules = append(c.rules, rule)
+	}
+	errs = append(errs, c.compileDirRules())
+	return errors.Join(errs...)
+}
+
+// validateExcludePattern checks that pattern is a valid regular expression
+// and returns an error explaining how to fix it if not.
+func validateExcludePattern(pattern string) error {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return fmt.Errorf("invalid pattern %q: %v\n"+
+			"Patterns are Go regular expressions; escape special characters such as * + ? ( ) [ with a backslash, e.g. %q",
+			pattern, err, regexp.QuoteMeta(pattern))
+	}
+	return nil
+}
+
+// matchRule returns the first rule matching command.
+func (app *App) matchRule(command string) (filterRule, bool) {
+	if app.config.rules == nil {
+		app.config.compilePatterns()
+	}
+	for _, rule := range app.config.rules {
+		if rule.re.MatchString(command) {
+			return rule, true
+		}
+	}
+	return filterRule{}, false
+}
+
+func (app *App) shouldExclude(command string) bool {
+	rule, matched := app.matchRule(command)
+	return matched && !rule.include
+}
+
+func (app *App) testExcludePattern(cmd *cobra.Command, args []string) {
+	command := args[0]
+	dir, _ := cmd.Flags().GetString("dir")
+	if dir == "" {
+		dir, _ = os.Getwd()
+	} else if expanded, err := expandHome(dir); err == nil {
+		dir, _ = filepath.Abs(expanded)
+	}
+
+	if reason := app.exclusionReason(command, dir); reason != nil {
+		fmt.Printf("Excluded by %s\n", reason)
+		return
+	}
+	if rule, matched := app.matchRule(command); matched && rule.include {
+		fmt.Printf("Included by rule: %s\n", rule.source)
+		return
+	}
+	fmt.Println("No rule matches: the command would be recorded")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type exclusionStat struct {
+	Kind    string
+	Rule    string
+	Hits    int
+	LastHit sql.NullTime
+}
+
+// countExclusion bumps the hit counter of the rule that excluded a command.
+// Only the rule is stored, never the excluded command itself.
+func (app *App) countExclusion(reason *exclusion) {
+	rule := reason.rule
+	if reason.file != "" {
+		rule = reason.file + ": " + reason.rule
+	}
+
+	_, err := app.db.Exec(`
+		INSERT INTO exclusion_stats (kind, rule, hits, last_hit) VALUES (?, ?, 1, ?)
+		ON CONFLICT(kind, rule) DO UPDATE SET hits = hits + 1, last_hit = excluded.last_hit`,
+		reason.kind, rule, time.Now(),
+	)
+	if err != nil {
+		ErrorLogger.Printf("Error counting exclusion: %v\n", err)
+	}
+}
+
+func (app *App) loadExclusionStats() ([]exclusionStat, error) {
+	rows, err := app.db.Query("SELECT kind, rule, hits, last_hit FROM exclusion_stats ORDER BY hits DESC, rule")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []exclusionStat
+	for rows.Next() {
+		var s exclusionStat
+		if err := rows.Scan(&s.Kind, &s.Rule, &s.Hits, &s.LastHit); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// unusedRules returns the configured exclude and directory rules that have
+// never excluded a command.
+func (app *App) unusedRules(stats []exclusionStat) []string {
+	hit := make(map[string]bool)
+	for _, s := range stats {
+		hit[s.Kind+"\x00"+s.Rule] = true
+	}
+
+	var unused []string
+	for _, source := range app.config.ExcludePatterns {
+		if rule, err := parseRule(source); err == nil && !rule.include && !hit["rule\x00"+source] {
+			unused = append(unused, source)
+		}
+	}
+	for _, source := range app.config.DirectoryRules {
+		if rule, err := parseDirRule(source); err == nil && !rule.include && !hit["directory\x00"+source] {
+			unused = append(unused, source+" (directory)")
+		}
+	}
+	return unused
+}
+
+func (app *App) showExclusionStats(cmd *cobra.Command, _ []string) {
+	reset, _ := cmd.Flags().GetBool("reset")
+	if reset {
+		if _, err := app.db.Exec("DELETE FROM exclusion_stats"); err != nil {
+			ErrorLogger.Printf("Error resetting exclusion statistics: %v\n", err)
+			return
+		}
+		fmt.Println("Exclusion statistics reset")
+		return
+	}
+
+	stats, err := app.loadExclusionStats()
+	if err != nil {
+		ErrorLogger.Printf("Error loading exclusion statistics: %v\n", err)
+		return
+	}
+
+	fmt.Println("Exclusion Statistics")
+	fmt.Println(strings.Repeat("=", 40))
+	if len(stats) == 0 {
+		fmt.Println("No commands have been excluded yet.")
+	}
+	for _, s := range stats {
+		lastHit := "-"
+		if s.LastHit.Valid {
+			lastHit = s.LastHit.Time.Format("2006-01-02 15:04")
+		}
+		fmt.Printf("  %6d  %-16s  %-11s  %s\n", s.Hits, lastHit, s.Kind, s.Rule)
+	}
+
+	if unused := app.unusedRules(stats); len(unused) > 0 {
+		fmt.Println("\nNever matched:")
+		for _, rule := range unused {
+			fmt.Printf("  %s\n", rule)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func (app *App) forgetCommands(cmd *cobra.Command, args []string) {
+	id, _ := cmd.Flags().GetInt("id")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	addExclude, _ := cmd.Flags().GetBool("exclude")
+
+	pattern := ""
+	if len(args) > 0 {
+		pattern = args[0]
+	}
+	if (pattern == "") == (id == 0) {
+		ErrorLogger.Println("Specify either a pattern or --id, but not both")
+		return
+	}
+	if addExclude && pattern == "" {
+		ErrorLogger.Println("--exclude requires a pattern")
+		return
+	}
+
+	matches, err := app.findCommandsToForget(pattern, id)
+	if err != nil {
+		ErrorLogger.Printf("Error finding commands: %v\n", err)
+		return
+	}
+
+	if len(matches) == 0 {
+		fmt.Println("No matching commands found.")
+	} else {
+		if dryRun {
+			fmt.Printf("Would forget %d command(s):\n", len(matches))
+		} else {
+			fmt.Printf("Forgetting %d command(s):\n", len(matches))
+		}
+		for _, c := range matches {
+			fmt.Printf("  [%d] %s\n", c.ID, c.Command)
+		}
+	}
+
+	if dryRun {
+		return
+	}
+
+	if len(matches) > 0 {
+		ids := make([]int, len(matches))
+		for i, c := range matches {
+			ids[i] = c.ID
+		}
+		removed, err := app.purgeCommands(ids)
+		if err != nil {
+			ErrorLogger.Printf("Error forgetting commands: %v\n", err)
+			return
+		}
+		fmt.Printf("Removed %d command(s)\n", removed)
+	}
+
+	if addExclude {
+		app.addRule(excludeRuleSource(pattern), 0)
+	}
+}
+
+// findCommandsToForget returns the commands matching either the regex pattern
+// or the given ID. Patterns are matched in Go because SQLite has no REGEXP
+// function by default.
+func (app *App) findCommandsToForget(pattern string, id int) ([]Command, error) {
+	if id != 0 {
+		var c Command
+		err := app.db.QueryRow(`
+			SELECT id, timestamp, full_command, directory FROM commands WHERE id = ?
+			UNION ALL SELECT id, timestamp, full_command, directory FROM trash WHERE id = ?`, id, id).
+			Scan(&c.ID, &c.Timestamp, &c.Command, &c.Directory)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		app.openCommand(&c)
+		return []Command{c}, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+
+	// Trashed commands are still on disk, so they are forgotten as well
+	rows, err := app.db.Query(`
+		SELECT id, timestamp, full_command, directory FROM commands
+		UNION ALL SELECT id, timestamp, full_command, directory FROM trash
+		ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var matches []Command
+	for rows.Next() {
+		var c Command
+		if err := rows.Scan(&c.ID, &c.Timestamp, &c.Command, &c.Directory); err != nil {
+			return nil, err
+		}
+		app.openCommand(&c)
+		if re.MatchString(c.Command) {
+			matches = append(matches, c)
+		}
+	}
+	return matches, rows.Err()
+}
+
+// purgeCommands deletes the given commands together with their word links and
+// any words no longer referenced, then vacuums the database and truncates the
+// WAL so the deleted data does not linger on disk.
+func (app *App) purgeCommands(ids []int) (int64, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // Safe to call even after commit
+
+	if _, err := tx.Exec("DELETE FROM command_word_positions WHERE command_id IN ("+placeholders+")", args...); err != nil {
+		return 0, fmt.Errorf("failed to delete word positions: %w", err)
+	}
+
+	result, err := tx.Exec("DELETE FROM commands WHERE id IN ("+placeholders+")", args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete commands: %w", err)
+	}
+	affected, _ := result.RowsAffected()
+
+	result, err = tx.Exec("DELETE FROM trash WHERE id IN ("+placeholders+")", args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete trashed commands: %w", err)
+	}
+	trashed, _ := result.RowsAffected()
+	affected += trashed
+
+	if _, err := tx.Exec("DELETE FROM words WHERE id NOT IN (SELECT word_id FROM command_word_positions)"); err != nil {
+		return 0, fmt.Errorf("failed to delete orphaned words: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if err := app.scrubFreePages(); err != nil {
+		return affected, err
+	}
+	return affected, nil
+}
+
+// scrubFreePages rewrites the database file and truncates the WAL so that
+// deleted rows are no longer recoverable from either file.
+func (app *App) scrubFreePages() error {
+	if _, err := app.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return fmt.Errorf("failed to checkpoint WAL: %w", err)
+	}
+	if _, err := app.db.Exec("VACUUM"); err != nil {
+		return fmt.Errorf("failed to vacuum database: %w", err)
+	}
+	// VACUUM itself goes through the WAL, so checkpoint once more
+	if _, err := app.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return fmt.Errorf("failed to checkpoint WAL: %w", err)
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ go 1.22.3
 require (
 	github.com/mattn/go-sqlite3 v1.14.32
 	github.com/spf13/cobra v1.9.1
+	golang.org/x/crypto v0.33.0
 )
 
 require (
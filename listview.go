@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	defaultListColumns = "id,time,dir,command"
+	defaultTermWidth   = 80
+	// maxDirWidth keeps long directories from crowding out the command
+	maxDirWidth = 30
+
+	colorReset = "\033[0m"
+	colorRed   = "\033[31m"
+	colorGreen = "\033[32m"
+	colorDim   = "\033[2m"
+)
+
+// oneLine keeps a multi-line command on its row of the compact view.
+var oneLine = strings.NewReplacer("\r\n", "↵", "\n", "↵", "\t", " ")
+
+// listColumnTitles are the columns --columns can choose from.
+var listColumnTitles = map[string]string{
+	"id":      "ID",
+	"time":    "WHEN",
+	"dir":     "DIRECTORY",
+	"exit":    "EXIT",
+	"host":    "HOST",
+	"star":    "*",
+	"tags":    "TAGS",
+	"command": "COMMAND",
+}
+
+// listView is how list and search print commands: compact, one line per
+// command, or the full multi-line form.
+type listView struct {
+	compact bool
+	color   bool
+	columns []string
+	width   int
+	home    string
+	now     time.Time
+}
+
+// listViewFromFlags reads --view and --columns. The compact view and color
+// are the default when stdout is a terminal; NO_COLOR turns color off.
+func listViewFromFlags(cmd *cobra.Command) (listView, error) {
+	view, _ := cmd.Flags().GetString("view")
+	columns, _ := cmd.Flags().GetString("columns")
+
+	tty := isTerminal(os.Stdout)
+	v := listView{color: tty && os.Getenv("NO_COLOR") == "", now: time.Now()}
+	switch view {
+	case "auto":
+		v.compact = tty
+	case "compact":
+		v.compact = true
+	case "full":
+	default:
+		return v, fmt.Errorf("invalid view %q: use auto, compact or full", view)
+	}
+
+	for _, column := range strings.Split(columns, ",") {
+		column = strings.TrimSpace(column)
+		if _, ok := listColumnTitles[column]; !ok {
+			names := make([]string, 0, len(listColumnTitles))
+			for name := range listColumnTitles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return v, fmt.Errorf("unknown column %q: use %s", column, strings.Join(names, ", "))
+		}
+		v.columns = append(v.columns, column)
+	}
+
+	v.width = terminalWidth(os.Stdout)
+	if v.width <= 0 {
+		v.width, _ = strconv.Atoi(os.Getenv("COLUMNS"))
+	}
+	if v.width <= 0 {
+		v.width = defaultTermWidth
+	}
+	v.home, _ = os.UserHomeDir()
+	return v, nil
+}
+
+// isTerminal reports whether f is a terminal rather than a pipe or file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// print writes commands in the chosen view.
+func (v listView) print(commands []Command) {
+	if !v.compact {
+		for _, c := range commands {
+			printCommand(c)
+		}
+		return
+	}
+	for _, line := range v.lines(commands) {
+		fmt.Println(line)
+	}
+}
+
+// lines renders the compact table: a header and one aligned line per command.
+// The command column takes the width left over by the others and is cut to
+// fit the terminal.
+func (v listView) lines(commands []Command) []string {
+	cells := make([][]string, len(commands))
+	widths := make([]int, len(v.columns))
+	for i, column := range v.columns {
+		widths[i] = utf8.RuneCountInString(listColumnTitles[column])
+	}
+	for row, c := range commands {
+		cells[row] = make([]string, len(v.columns))
+		for i, column := range v.columns {
+			cell := v.cell(c, column)
+			if column == "dir" {
+				cell = truncateLeft(cell, maxDirWidth)
+			}
+			cells[row][i] = cell
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+
+	// Whatever the other columns and the separators leave goes to the command
+	commandWidth := v.width
+	for i, column := range v.columns {
+		if column != "command" {
+			commandWidth -= widths[i] + 2
+		}
+	}
+	commandWidth = max(commandWidth, 10)
+	for i, column := range v.columns {
+		if column == "command" {
+			widths[i] = min(widths[i], commandWidth)
+		}
+	}
+
+	format := func(values []string, c *Command) string {
+		parts := make([]string, len(values))
+		for i, column := range v.columns {
+			value := values[i]
+			if column == "command" {
+				value = truncateRight(value, commandWidth)
+			}
+			if i < len(values)-1 {
+				value += strings.Repeat(" ", max(widths[i]-utf8.RuneCountInString(value), 0))
+			}
+			parts[i] = v.colorize(column, value, c)
+		}
+		return strings.TrimRight(strings.Join(parts, "  "), " ")
+	}
+
+	header := make([]string, len(v.columns))
+	for i, column := range v.columns {
+		header[i] = listColumnTitles[column]
+	}
+	lines := []string{format(header, nil)}
+	if v.color {
+		lines[0] = colorDim + lines[0] + colorReset
+	}
+	for row := range commands {
+		lines = append(lines, format(cells[row], &commands[row]))
+	}
+	return lines
+}
+
+func (v listView) cell(c Command, column string) string {
+	switch column {
+	case "id":
+		return strconv.Itoa(c.ID)
+	case "time":
+		return relativeTime(c.Timestamp, v.now)
+	case "dir":
+		return abbreviateHome(c.Directory, v.home)
+	case "exit":
+		if c.ExitCode == nil {
+			return "-"
+		}
+		return strconv.Itoa(*c.ExitCode)
+	case "host":
+		return c.Host
+	case "star":
+		if c.Starred {
+			return "*"
+		}
+		return ""
+	case "tags":
+		return strings.Join(c.Tags, ",")
+	case "command":
+		return oneLine.Replace(c.Command)
+	}
+	return ""
+}
+
+// colorize colors the exit column, and the command when it last failed.
+func (v listView) colorize(column, value string, c *Command) string {
+	if !v.color || c == nil || c.ExitCode == nil {
+		return value
+	}
+	switch {
+	case column == "exit" && *c.ExitCode == 0:
+		return colorGreen + value + colorReset
+	case (column == "exit" || column == "command") && *c.ExitCode != 0:
+		return colorRed + value + colorReset
+	}
+	return value
+}
+
+// relativeTime describes how long ago t was, falling back to the date after
+// a month.
+func relativeTime(t, now time.Time) string {
+	d := now.Sub(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	case d < 30*24*time.Hour:
+		return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+	}
+	return t.Format("2006-01-02")
+}
+
+// abbreviateHome writes the home directory as ~.
+func abbreviateHome(dir, home string) string {
+	if home == "" || home == "/" {
+		return dir
+	}
+	if dir == home {
+		return "~"
+	}
+	if rest, ok := strings.CutPrefix(dir, home+"/"); ok {
+		return "~/" + rest
+	}
+	return dir
+}
+
+// truncateRight cuts s to width characters, marking the cut with an ellipsis.
+func truncateRight(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:width-1]) + "…"
+}
+
+// truncateLeft keeps the end of s, which is the informative part of a path.
+func truncateLeft(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	return "…" + string(runes[len(runes)-width+1:])
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -18,8 +19,21 @@ const (
 )
 
 type Config struct {
-	ExcludePatterns []string `json:"exclude_patterns"`
-	DatabasePath    string   `json:"database_path"`
+	ExcludePatterns      []string         `json:"exclude_patterns"`
+	DirectoryRules       []string         `json:"directory_rules,omitempty"`
+	DirectoryIncludeOnly bool             `json:"directory_include_only,omitempty"`
+	DatabasePath         string           `json:"database_path"`
+	IgnoreSpace          bool             `json:"ignore_space"`
+	OptOutMarker         string           `json:"opt_out_marker"`
+	Sync                 SyncConfig       `json:"sync"`
+	Encryption           EncryptionConfig `json:"encryption"`
+	Retention            RetentionConfig  `json:"retention"`
+	Aliases              AliasConfig      `json:"aliases"`
+	Projects             ProjectConfig    `json:"projects"`
+
+	// Compiled form of ExcludePatterns and DirectoryRules, built once by compilePatterns
+	rules    []filterRule
+	dirRules []dirRule
 }
 
 type Command struct {
@@ -27,12 +41,19 @@ type Command struct {
 	Timestamp time.Time `json:"timestamp"`
 	Command   string    `json:"command"`
 	Directory string    `json:"directory"`
+	Host      string    `json:"host,omitempty"`
 	Words     []string  `json:"words"`
+	Starred   bool      `json:"starred,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	// ExitCode is the exit status of the latest run, if it was recorded
+	ExitCode *int `json:"exit_code,omitempty"`
 }
 
 type App struct {
 	db     *sql.DB
 	config *Config
+	cipher *fieldCipher // nil unless encryption is enabled
 }
 
 func main() {
@@ -46,7 +67,11 @@ func main() {
 		Use:   appName,
 		Short: "Track and manage bash command history",
 		Long:  "A CLI tool to track all bash commands in an SQLite database with filtering and search capabilities.",
+
+		PersistentPreRunE: checkOutputFlags,
 	}
+	rootCmd.PersistentFlags().StringP("output", "o", outputText, "Output format of read commands like list, search and stats: "+strings.Join(outputFormats, ", "))
+	rootCmd.PersistentFlags().String("format", "", "Go template applied to each result, e.g. '{{.ID}} {{.Command}}' (overrides --output)")
 
 	// Add command to record a new command
 	recordCmd := &cobra.Command{
@@ -55,31 +80,162 @@ func main() {
 		Args:  cobra.MinimumNArgs(1),
 		Run:   app.recordCommand,
 	}
+	recordCmd.Flags().Int("exit-code", 0, "Exit status of the command, for typos and failure stats")
+	recordCmd.Flags().Int("history-id", 0, "Shell history number of the command; the same number is not recorded twice in a session")
 
 	// Add command to list recent commands
 	listCmd := &cobra.Command{
-		Use:   "list",
-		Short: "List recent commands",
-		Run:   app.listCommands,
+		Use:         "list",
+		Short:       "List recent commands",
+		Annotations: rendersOutput,
+		Run:         app.listCommands,
 	}
 	listCmd.Flags().IntP("limit", "l", 20, "Number of commands to show")
 	listCmd.Flags().StringP("filter", "f", "", "Filter commands by pattern")
 	listCmd.Flags().StringP("directory", "d", "", "Filter by directory")
+	listCmd.Flags().Bool("starred", false, "Only show starred commands")
+	listCmd.Flags().String("tag", "", "Only show commands with this tag")
+	listCmd.Flags().String("view", "auto", "compact (one line each), full, or auto: compact when printing to a terminal")
+	listCmd.Flags().String("columns", defaultListColumns, "Columns of the compact view: id, time, dir, exit, host, star, tags, command")
 
 	// Add command to search commands
 	searchCmd := &cobra.Command{
-		Use:   "search [pattern]",
-		Short: "Search commands by pattern",
+		Use:         "search [pattern]",
+		Short:       "Search commands by pattern",
+		Args:        cobra.ExactArgs(1),
+		Annotations: rendersOutput,
+		Run:         app.searchCommands,
+	}
+	searchCmd.Flags().Bool("starred", false, "Only show starred commands")
+	searchCmd.Flags().String("tag", "", "Only show commands with this tag")
+	searchCmd.Flags().String("view", "auto", "compact (one line each), full, or auto: compact when printing to a terminal")
+	searchCmd.Flags().String("columns", defaultListColumns, "Columns of the compact view: id, time, dir, exit, host, star, tags, command")
+
+	// Add commands to annotate commands
+	starCmd := &cobra.Command{
+		Use:   "star [id...]",
+		Short: "Star commands to keep them forever and find them quickly",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   app.starCommands,
+	}
+	starCmd.Flags().Bool("remove", false, "Remove the star instead")
+
+	tagCmd := &cobra.Command{
+		Use:   "tag [id] [tag...]",
+		Short: "Tag a command",
+		Args:  cobra.MinimumNArgs(2),
+		Run:   app.tagCommand,
+	}
+	tagCmd.Flags().Bool("remove", false, "Remove the tags instead")
+
+	noteCmd := &cobra.Command{
+		Use:   "note [id] [text...]",
+		Short: "Attach a note to a command, or show it",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   app.noteCommand,
+	}
+	noteCmd.Flags().Bool("clear", false, "Remove the note")
+
+	// Add context command
+	contextCmd := &cobra.Command{
+		Use:         "context [id]",
+		Short:       "Show the commands run before and after a command",
+		Args:        cobra.ExactArgs(1),
+		Annotations: rendersOutput,
+		Run:         app.showContext,
+	}
+	contextCmd.Flags().IntP("number", "n", 5, "Number of commands to show before and after")
+
+	// Add suggest command
+	suggestCmd := &cobra.Command{
+		Use:   "suggest",
+		Short: "Predict the next command from the last one and the current directory",
+		Run:   app.suggestCommands,
+	}
+	suggestCmd.Flags().IntP("number", "n", 5, "Number of suggestions")
+	suggestCmd.Flags().String("last", "", "Command to predict from (default: the last one in this session)")
+	suggestCmd.Flags().String("dir", "", "Directory to predict for (default: the current one)")
+	suggestCmd.Flags().BoolP("verbose", "v", false, "Show scores")
+
+	// Add snippet commands
+	snippetCmd := &cobra.Command{
+		Use:         "snippet",
+		Short:       "Save commands as parameterized templates and run them",
+		Annotations: rendersOutput,
+		Run:         app.listSnippets,
+	}
+
+	snippetSaveCmd := &cobra.Command{
+		Use:   "save [id]",
+		Short: "Turn a recorded command into a snippet",
+		Long:  "Turn a recorded command into a snippet. --name=value options become {{name}} placeholders automatically; --param name=value replaces other values.",
 		Args:  cobra.ExactArgs(1),
-		Run:   app.searchCommands,
+		Run:   app.saveSnippetFromCommand,
 	}
+	snippetSaveCmd.Flags().String("name", "", "Snippet name")
+	snippetSaveCmd.Flags().String("description", "", "What the snippet does")
+	snippetSaveCmd.Flags().StringArray("param", nil, "Turn a value into a placeholder (name=value, repeatable)")
+	snippetSaveCmd.Flags().Bool("overwrite", false, "Replace an existing snippet with the same name")
+	snippetSaveCmd.MarkFlagRequired("name")
+
+	snippetRunCmd := &cobra.Command{
+		Use:                "run [name] [--param=value...] [--exec]",
+		Short:              "Fill in a snippet and print it, or run it with --exec",
+		DisableFlagParsing: true,
+		ValidArgsFunction:  app.completeSnippetNames,
+		Run:                app.runSnippet,
+	}
+
+	snippetListCmd := &cobra.Command{
+		Use:         "list",
+		Short:       "List snippets",
+		Annotations: rendersOutput,
+		Run:         app.listSnippets,
+	}
+
+	snippetDeleteCmd := &cobra.Command{
+		Use:               "delete [name]",
+		Short:             "Delete a snippet",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: app.completeSnippetNames,
+		Run:               app.deleteSnippet,
+	}
+
+	snippetExportCmd := &cobra.Command{
+		Use:   "export [file]",
+		Short: "Write all snippets to a shareable JSON file (default: stdout)",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   app.exportSnippets,
+	}
+
+	snippetImportCmd := &cobra.Command{
+		Use:   "import [file]",
+		Short: "Import snippets from a file ('-' for stdin)",
+		Args:  cobra.ExactArgs(1),
+		Run:   app.importSnippets,
+	}
+	snippetImportCmd.Flags().Bool("overwrite", false, "Replace snippets with the same name")
+
+	snippetCmd.AddCommand(snippetSaveCmd, snippetRunCmd, snippetListCmd, snippetDeleteCmd, snippetExportCmd, snippetImportCmd)
 
 	// Add command to show statistics
 	statsCmd := &cobra.Command{
-		Use:   "stats",
-		Short: "Show command statistics",
-		Run:   app.showStats,
+		Use:         "stats",
+		Short:       "Show command statistics",
+		Annotations: rendersOutput,
+		Run:         app.showStats,
 	}
+	statsCmd.PersistentFlags().String("dir", "", "Only count commands run in this directory")
+	statsCmd.PersistentFlags().Bool("recursive", false, "With --dir, include its subdirectories")
+
+	statsActivityCmd := &cobra.Command{
+		Use:         "activity",
+		Short:       "Show when commands are run: heatmap, sparklines, busiest days and streaks",
+		Annotations: rendersOutput,
+		Run:         app.showActivity,
+	}
+	statsActivityCmd.Flags().String("since", "", "Only count runs since a date, RFC 3339 time or age like 90d")
+	statsCmd.AddCommand(statsActivityCmd)
 
 	// Add command to manage configuration
 	configCmd := &cobra.Command{
@@ -88,9 +244,10 @@ func main() {
 	}
 
 	configShowCmd := &cobra.Command{
-		Use:   "show",
-		Short: "Show current configuration",
-		Run:   app.showConfig,
+		Use:         "show",
+		Short:       "Show current configuration",
+		Annotations: rendersOutput,
+		Run:         app.showConfig,
 	}
 
 	configAddExcludeCmd := &cobra.Command{
@@ -99,6 +256,15 @@ func main() {
 		Args:  cobra.ExactArgs(1),
 		Run:   app.addExcludePattern,
 	}
+	configAddExcludeCmd.Flags().IntP("position", "p", 0, "Insert the rule at this position (default: append)")
+
+	configAddIncludeCmd := &cobra.Command{
+		Use:   "add-include [pattern]",
+		Short: "Add an include pattern that overrides later exclude patterns",
+		Args:  cobra.ExactArgs(1),
+		Run:   app.addIncludePattern,
+	}
+	configAddIncludeCmd.Flags().IntP("position", "p", 1, "Insert the rule at this position")
 
 	configRemoveExcludeCmd := &cobra.Command{
 		Use:   "remove-exclude [pattern]",
@@ -107,6 +273,51 @@ func main() {
 		Run:   app.removeExcludePattern,
 	}
 
+	configRemoveIncludeCmd := &cobra.Command{
+		Use:   "remove-include [pattern]",
+		Short: "Remove an include pattern",
+		Args:  cobra.ExactArgs(1),
+		Run:   app.removeIncludePattern,
+	}
+
+	configTestCmd := &cobra.Command{
+		Use:   "test [command]",
+		Short: "Show which rule, if any, matches a command",
+		Args:  cobra.ExactArgs(1),
+		Run:   app.testExcludePattern,
+	}
+	configTestCmd.Flags().String("dir", "", "Working directory to test (default: current directory)")
+
+	configStatsCmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Show how often each exclude rule fired",
+		Run:   app.showExclusionStats,
+	}
+	configStatsCmd.Flags().Bool("reset", false, "Reset all exclusion counters")
+
+	configAddDirRuleCmd := &cobra.Command{
+		Use:   "add-dir-rule [path|glob]",
+		Short: "Add a directory rule; prefix with ! to always record in that directory",
+		Args:  cobra.ExactArgs(1),
+		Run:   app.addDirRule,
+	}
+	configAddDirRuleCmd.Flags().IntP("position", "p", 0, "Insert the rule at this position (default: append)")
+
+	configRemoveDirRuleCmd := &cobra.Command{
+		Use:   "remove-dir-rule [path|glob]",
+		Short: "Remove a directory rule",
+		Args:  cobra.ExactArgs(1),
+		Run:   app.removeDirRule,
+	}
+
+	configIncludeOnlyCmd := &cobra.Command{
+		Use:       "include-only [on|off]",
+		Short:     "Only record in directories matched by an include directory rule",
+		Args:      cobra.ExactArgs(1),
+		ValidArgs: []string{"on", "off"},
+		Run:       app.setDirIncludeOnly,
+	}
+
 	// Add setup command
 	setupCmd := &cobra.Command{
 		Use:   "setup",
@@ -121,9 +332,207 @@ func main() {
 		Run:   app.cleanupCommands,
 	}
 	cleanupCmd.Flags().IntP("days", "d", 90, "Remove commands older than this many days")
+	cleanupCmd.Flags().Bool("policy", false, "Apply the retention policy from the config instead of --days")
+	cleanupCmd.Flags().BoolP("dry-run", "n", false, "Show what would be removed without removing it")
+	cleanupCmd.Flags().String("directory", "", "Only remove commands run in this directory or below")
+	cleanupCmd.Flags().String("pattern", "", "Only remove commands matching this regex")
+	cleanupCmd.Flags().String("host", "", "Only remove commands recorded on this host")
+	cleanupCmd.Flags().String("before", "", "Only remove commands run before this date or age (e.g. 2024-01-31, 30d)")
+	cleanupCmd.Flags().String("after", "", "Only remove commands run after this date or age")
 
-	configCmd.AddCommand(configShowCmd, configAddExcludeCmd, configRemoveExcludeCmd)
-	rootCmd.AddCommand(recordCmd, listCmd, searchCmd, statsCmd, configCmd, setupCmd, cleanupCmd)
+	// Add trash command
+	trashCmd := &cobra.Command{
+		Use:         "trash",
+		Short:       "List, restore or empty commands removed by cleanup",
+		Annotations: rendersOutput,
+		Run:         app.listTrash,
+	}
+
+	trashRestoreCmd := &cobra.Command{
+		Use:   "restore",
+		Short: "Restore the most recent cleanup, or a given batch",
+		Run:   app.restoreFromTrash,
+	}
+	trashRestoreCmd.Flags().Int64("batch", 0, "Batch to restore (see 'trash')")
+	trashRestoreCmd.Flags().Bool("all", false, "Restore everything in the trash")
+
+	trashEmptyCmd := &cobra.Command{
+		Use:   "empty",
+		Short: "Permanently delete everything in the trash",
+		Run:   app.emptyTrash,
+	}
+
+	trashCmd.AddCommand(trashRestoreCmd, trashEmptyCmd)
+
+	// Add doctor command
+	doctorCmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Check database integrity and repair problems",
+		Run:   app.runDoctor,
+	}
+	doctorCmd.Flags().Bool("fix", false, "Repair the problems found")
+
+	// Add backup/restore commands
+	backupCmd := &cobra.Command{
+		Use:   "backup [file]",
+		Short: "Write a consistent backup of the database",
+		Args:  cobra.ExactArgs(1),
+		Run:   app.backupDatabase,
+	}
+	backupCmd.Flags().BoolP("gzip", "z", false, "Compress the backup with gzip")
+	backupCmd.Flags().IntP("keep", "k", 0, "Rotate existing backups, keeping this many files")
+
+	restoreCmd := &cobra.Command{
+		Use:   "restore [file]",
+		Short: "Replace the database with a backup",
+		Args:  cobra.ExactArgs(1),
+		Run:   app.restoreDatabase,
+	}
+
+	// Add sync command
+	syncCmd := &cobra.Command{
+		Use:   "sync",
+		Short: "Merge history with other hosts through a shared directory",
+		Run:   app.syncHistory,
+	}
+	syncCmd.Flags().String("dir", "", "Shared sync directory (default: sync.dir from the config)")
+	syncCmd.Flags().String("remote", "", "Sync server URL (default: sync.remote from the config)")
+
+	serveSyncCmd := &cobra.Command{
+		Use:   "serve-sync",
+		Short: "Run a sync server other hosts can push to and pull from",
+		Run:   app.serveSync,
+	}
+	serveSyncCmd.Flags().String("addr", "127.0.0.1:8787", "Address to listen on")
+	serveSyncCmd.Flags().String("db", "", "Server database (default: sync-server.db next to the history database)")
+	serveSyncCmd.Flags().String("token", "", "Token clients must present (default: $"+syncTokenEnv+")")
+	serveSyncCmd.Flags().String("tls-cert", "", "TLS certificate file")
+	serveSyncCmd.Flags().String("tls-key", "", "TLS key file")
+
+	// Add pause/resume commands
+	pauseCmd := &cobra.Command{
+		Use:   "pause",
+		Short: "Pause recording for the current shell session",
+		Run:   app.pauseRecording,
+	}
+	pauseCmd.Flags().Bool("all", false, "Pause recording for all sessions")
+
+	resumeCmd := &cobra.Command{
+		Use:   "resume",
+		Short: "Resume recording for the current shell session",
+		Run:   app.resumeRecording,
+	}
+	resumeCmd.Flags().Bool("all", false, "Resume recording for all sessions")
+
+	// Add forget command
+	forgetCmd := &cobra.Command{
+		Use:   "forget [pattern]",
+		Short: "Permanently remove commands matching a pattern or ID",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   app.forgetCommands,
+	}
+	forgetCmd.Flags().Int("id", 0, "Forget the command with this ID")
+	forgetCmd.Flags().BoolP("dry-run", "n", false, "Show what would be removed without deleting")
+	forgetCmd.Flags().Bool("exclude", false, "Also add the pattern to the exclude list")
+
+	// Add encryption command
+	encryptionCmd := &cobra.Command{
+		Use:   "encryption",
+		Short: "Manage encryption of commands and directories at rest",
+	}
+
+	encryptionEnableCmd := &cobra.Command{
+		Use:   "enable",
+		Short: "Encrypt the history database",
+		Run:   app.enableEncryption,
+	}
+	encryptionEnableCmd.Flags().String("key-file", "", "Key file, created if missing (default: key next to the database)")
+	encryptionEnableCmd.Flags().Bool("passphrase", false, "Derive the key from $"+passphraseEnv+" instead of a key file")
+
+	encryptionDisableCmd := &cobra.Command{
+		Use:   "disable",
+		Short: "Decrypt the history database",
+		Run:   app.disableEncryption,
+	}
+
+	encryptionStatusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show whether encryption is enabled",
+		Run:   app.showEncryptionStatus,
+	}
+
+	// Add projects command
+	projectsCmd := &cobra.Command{
+		Use:         "projects",
+		Short:       "Show command counts, top commands and last activity per project",
+		Long:        "Group recorded directories into projects by their nearest root containing a marker (.git unless configured under projects.markers) and summarize each.",
+		Annotations: rendersOutput,
+		Run:         app.showProjects,
+	}
+	projectsCmd.Flags().IntP("number", "n", 3, "Top commands to show per project")
+	projectsCmd.Flags().StringArray("marker", nil, "File or directory marking a project root (repeatable, overrides the config)")
+
+	// Add typos command
+	typosCmd := &cobra.Command{
+		Use:         "typos",
+		Short:       "Find likely typos and the most frequently failing commands",
+		Annotations: rendersOutput,
+		Run:         app.showTypos,
+	}
+	typosCmd.Flags().IntP("number", "n", 5, "Failing commands to show per directory")
+	typosCmd.Flags().Int("min-runs", 5, "Runs before a program counts as frequent")
+	typosCmd.Flags().String("dir", "", "Only show failing commands in this directory")
+
+	// Add aliases command
+	aliasesCmd := &cobra.Command{
+		Use:   "aliases",
+		Short: "Suggest aliases for long, repeated commands",
+	}
+
+	aliasesSuggestCmd := &cobra.Command{
+		Use:   "suggest",
+		Short: "Propose aliases and shell functions with the keystrokes they save",
+		Run:   app.suggestAliases,
+	}
+	aliasesSuggestCmd.Flags().IntP("number", "n", 10, "Number of suggestions")
+	aliasesSuggestCmd.Flags().Int("min-count", 3, "Only consider commands run at least this many times")
+	aliasesSuggestCmd.Flags().Int("min-length", 12, "Only consider commands at least this long")
+	aliasesSuggestCmd.Flags().Bool("write", false, "Append the suggestions to the aliases file")
+	aliasesSuggestCmd.Flags().String("file", "", "Aliases file (default: ~/.bashtrack/aliases.sh)")
+
+	aliasesWarnCmd := &cobra.Command{
+		Use:       "warn [on|off]",
+		Short:     "Show or set whether record points out commands an alias covers",
+		Args:      cobra.MaximumNArgs(1),
+		ValidArgs: []string{"on", "off"},
+		Run:       app.setAliasWarnings,
+	}
+
+	aliasesCmd.AddCommand(aliasesSuggestCmd, aliasesWarnCmd)
+
+	// Add completion commands
+	completionCmd := &cobra.Command{
+		Use:       "completion [bash|zsh|fish]",
+		Short:     "Print a shell completion script",
+		Long:      "Print a shell completion script. With --history, the bash script also completes arguments of other commands from recorded history.",
+		Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+		ValidArgs: []string{"bash", "zsh", "fish"},
+		Run:       app.generateCompletion,
+	}
+	completionCmd.Flags().Bool("history", false, "Also complete arguments of other commands from history (bash only)")
+	completionCmd.Flags().StringSlice("commands", nil, "Only complete these commands from history (default: all without their own completion)")
+
+	completeCmd := &cobra.Command{
+		Use:                "complete -- [words...]",
+		Short:              "Print history-based completions for the last word",
+		Hidden:             true,
+		DisableFlagParsing: true,
+		Run:                app.completeFromHistory,
+	}
+
+	encryptionCmd.AddCommand(encryptionEnableCmd, encryptionDisableCmd, encryptionStatusCmd)
+	configCmd.AddCommand(configShowCmd, configAddExcludeCmd, configRemoveExcludeCmd, configAddIncludeCmd, configRemoveIncludeCmd, configAddDirRuleCmd, configRemoveDirRuleCmd, configIncludeOnlyCmd, configTestCmd, configStatsCmd)
+	rootCmd.AddCommand(recordCmd, listCmd, searchCmd, statsCmd, projectsCmd, configCmd, setupCmd, cleanupCmd, forgetCmd, pauseCmd, resumeCmd, doctorCmd, backupCmd, restoreCmd, syncCmd, serveSyncCmd, encryptionCmd, trashCmd, starCmd, tagCmd, noteCmd, snippetCmd, contextCmd, suggestCmd, typosCmd, aliasesCmd, completionCmd, completeCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal(err)
@@ -153,10 +562,21 @@ func NewApp() (*App, error) {
 		return nil, fmt.Errorf("failed to initialize database: %w", err)
 	}
 
-	return &App{
+	app := &App{
 		db:     db,
 		config: config,
-	}, nil
+	}
+
+	// Refuse to run without the key rather than record plaintext into an
+	// encrypted database
+	if config.Encryption.Enabled {
+		if app.cipher, err = loadFieldCipher(config.Encryption, db); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to load encryption key: %w", err)
+		}
+	}
+
+	return app, nil
 }
 
 func (app *App) Close() {
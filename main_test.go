@@ -1,12 +1,45 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
+
+	"github.com/spf13/cobra"
 )
 
+// newTestApp returns an App backed by a fresh database in a temporary
+// directory, which is closed when the test ends.
+func newTestApp(t *testing.T) *App {
+	t.Helper()
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := initDatabase(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return &App{
+		db: db,
+		config: &Config{
+			DatabasePath: dbPath,
+		},
+	}
+}
+
 func TestShouldExclude(t *testing.T) {
 	app := &App{
 		config: &Config{
@@ -187,3 +220,1481 @@ func TestCommandDeduplication(t *testing.T) {
 		t.Errorf("Expected 1 command recorded (deduplicated), got %d", count)
 	}
 }
+
+func TestForgetCommands(t *testing.T) {
+	app := newTestApp(t)
+	db := app.db
+
+	app.recordCommand(nil, []string{"mysql", "-p", "hunter2"})
+	app.recordCommand(nil, []string{"git", "status"})
+
+	matches, err := app.findCommandsToForget("hunter2", 0)
+	if err != nil {
+		t.Fatalf("Failed to find commands: %v", err)
+	}
+	if len(matches) != 1 {
+		t.Fatalf("Expected 1 matching command, got %d", len(matches))
+	}
+
+	removed, err := app.purgeCommands([]int{matches[0].ID})
+	if err != nil {
+		t.Fatalf("Failed to purge commands: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Expected 1 command removed, got %d", removed)
+	}
+
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM commands").Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected 1 command left, got %d", count)
+	}
+
+	// Orphaned words must be gone as well
+	db.QueryRow("SELECT COUNT(*) FROM words WHERE word IN ('mysql', '-p', 'hunter2')").Scan(&count)
+	if count != 0 {
+		t.Errorf("Expected orphaned words to be removed, got %d", count)
+	}
+}
+
+func TestExcludePatternValidation(t *testing.T) {
+	if err := validateExcludePattern("^git (push|pull)"); err != nil {
+		t.Errorf("Expected valid pattern, got %v", err)
+	}
+	if err := validateExcludePattern("*.secret"); err == nil {
+		t.Error("Expected error for invalid pattern")
+	}
+
+	// Invalid patterns are skipped but the valid ones still apply
+	app := &App{
+		config: &Config{
+			ExcludePatterns: []string{"(unclosed", "^vim"},
+		},
+	}
+	if err := app.config.compilePatterns(); err == nil {
+		t.Error("Expected compilePatterns to report the invalid pattern")
+	}
+	if !app.shouldExclude("vim main.go") {
+		t.Errorf("Expected %q to be excluded by the remaining valid pattern", "vim main.go")
+	}
+}
+
+func BenchmarkShouldExclude(b *testing.B) {
+	app := &App{
+		config: &Config{
+			ExcludePatterns: defaultExcludePatterns(),
+		},
+	}
+	app.config.compilePatterns()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		app.shouldExclude("docker compose up --build -d web")
+	}
+}
+
+// BenchmarkShouldExcludeUncompiled measures the previous approach of
+// compiling every pattern on each call, for comparison.
+func BenchmarkShouldExcludeUncompiled(b *testing.B) {
+	patterns := defaultExcludePatterns()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, pattern := range patterns {
+			if matched, _ := regexp.MatchString(pattern, "docker compose up --build -d web"); matched {
+				break
+			}
+		}
+	}
+}
+
+func TestFilterRuleOrdering(t *testing.T) {
+	app := &App{
+		config: &Config{
+			ExcludePatterns: []string{
+				"!^ssh-keygen",
+				".*key.*",
+				`\!important`,
+			},
+		},
+	}
+
+	tests := []struct {
+		command  string
+		expected bool
+	}{
+		{"ssh-keygen -t ed25519", false},
+		{"gpg --export-key", true},
+		{"echo !important", true},
+		{"git status", false},
+	}
+
+	for _, test := range tests {
+		result := app.shouldExclude(test.command)
+		if result != test.expected {
+			t.Errorf("shouldExclude(%q) = %v, expected %v", test.command, result, test.expected)
+		}
+	}
+
+	rules := insertRule([]string{"a", "b"}, "c", 1)
+	if rules[0] != "c" || len(rules) != 3 {
+		t.Errorf("insertRule at position 1 = %v, expected c first", rules)
+	}
+}
+
+func TestDirectoryRules(t *testing.T) {
+	tempDir := t.TempDir()
+	work := filepath.Join(tempDir, "work")
+	secrets := filepath.Join(tempDir, "work", "client", "secrets")
+	ignored := filepath.Join(tempDir, "ignored", "sub")
+	partial := filepath.Join(tempDir, "partial")
+	for _, dir := range []string{secrets, ignored, partial} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Failed to create %s: %v", dir, err)
+		}
+	}
+	os.WriteFile(filepath.Join(tempDir, "ignored", ignoreFile), nil, 0644)
+	os.WriteFile(filepath.Join(partial, ignoreFile), []byte("# local rules\n^make deploy\n"), 0644)
+
+	app := newTestApp(t)
+	app.config.DirectoryRules = []string{
+		filepath.Join(work, "*", "secrets"),
+		"!" + work,
+		filepath.Join(tempDir, "other"),
+	}
+
+	tests := []struct {
+		command  string
+		dir      string
+		excluded bool
+	}{
+		{"git status", work, false},
+		{"git status", secrets, true},
+		{"git status", filepath.Join(tempDir, "other", "deep"), true},
+		{"git status", ignored, true},
+		{"make deploy", partial, true},
+		{"make test", partial, false},
+	}
+
+	for _, test := range tests {
+		reason := app.exclusionReason(test.command, test.dir)
+		if (reason != nil) != test.excluded {
+			t.Errorf("exclusionReason(%q, %q) = %v, expected excluded=%v", test.command, test.dir, reason, test.excluded)
+		}
+	}
+
+	// Nothing run inside an excluded directory reaches the database
+	originalWd, _ := os.Getwd()
+	defer os.Chdir(originalWd)
+	os.Chdir(secrets)
+	app.recordCommand(nil, []string{"cat", "token.txt"})
+	var count int
+	app.db.QueryRow("SELECT COUNT(*) FROM commands").Scan(&count)
+	if count != 0 {
+		t.Errorf("Expected no commands recorded in %s, got %d", secrets, count)
+	}
+
+	// Include-only mode excludes every directory without an include rule
+	app.config.DirectoryIncludeOnly = true
+	if reason := app.exclusionReason("git status", work); reason != nil {
+		t.Errorf("Include-only mode excluded included directory: %v", reason)
+	}
+	if reason := app.exclusionReason("git status", partial); reason == nil || reason.rule != includeOnlyRule {
+		t.Errorf("Include-only mode recorded in %s: %v", partial, reason)
+	}
+	if reason := app.exclusionReason("git status", secrets); reason == nil || reason.rule == includeOnlyRule {
+		t.Errorf("Include-only mode should keep the exclude rule for %s: %v", secrets, reason)
+	}
+
+	sep := string(filepath.Separator)
+	for _, c := range []struct {
+		dir, root string
+		want      bool
+	}{
+		{sep + filepath.Join("srv", "app", "x"), sep + filepath.Join("srv", "app") + sep, true},
+		{sep + filepath.Join("srv", "apple"), sep + filepath.Join("srv", "app"), false},
+		{sep + "srv", sep, true},
+	} {
+		if got := isWithin(c.dir, c.root); got != c.want {
+			t.Errorf("isWithin(%q, %q) = %v, want %v", c.dir, c.root, got, c.want)
+		}
+	}
+}
+
+func TestExclusionStats(t *testing.T) {
+	app := newTestApp(t)
+	app.config.ExcludePatterns = []string{"^ls", "^vim", "!^git", ".*secret.*"}
+
+	app.recordCommand(nil, []string{"ls", "-la"})
+	app.recordCommand(nil, []string{"ls"})
+	app.recordCommand(nil, []string{"cat", "secret.txt"})
+	app.recordCommand(nil, []string{"git", "status"})
+
+	stats, err := app.loadExclusionStats()
+	if err != nil {
+		t.Fatalf("Failed to load exclusion stats: %v", err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("Expected stats for 2 rules, got %d", len(stats))
+	}
+	if stats[0].Rule != "^ls" || stats[0].Hits != 2 {
+		t.Errorf("Expected ^ls with 2 hits first, got %s with %d", stats[0].Rule, stats[0].Hits)
+	}
+
+	unused := app.unusedRules(stats)
+	if len(unused) != 1 || unused[0] != "^vim" {
+		t.Errorf("Expected only ^vim to be unused, got %v", unused)
+	}
+}
+
+func TestRecordingOptOut(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(sessionEnv, "test-session")
+	t.Setenv(pausedEnv, "")
+
+	app := newTestApp(t)
+	app.config.IgnoreSpace = true
+	app.config.OptOutMarker = defaultOptOutMarker
+
+	app.recordCommand(nil, []string{" echo spaced"})
+	app.recordCommand(nil, []string{"echo marked #nobt"})
+
+	// Pausing the session skips everything until resumed
+	path, _ := pauseFile("test-session")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	os.WriteFile(path, nil, 0644)
+	app.recordCommand(nil, []string{"echo paused"})
+	os.Remove(path)
+
+	app.recordCommand(nil, []string{"echo recorded"})
+
+	var count int
+	app.db.QueryRow("SELECT COUNT(*) FROM commands").Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected only 1 command recorded, got %d", count)
+	}
+}
+
+func TestRecordHookKeepsLeadingSpace(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+
+	// Run the hook with history and bashtrack stubbed out
+	var script bytes.Buffer
+	script.WriteString("history() { echo '  5   ls'; }\n")
+	script.WriteString("fake_bashtrack() { printf '[%s]' \"${@: -1}\"; }\n")
+	printRecordFunction(&script, "fake_bashtrack", true)
+	script.WriteString("bashtrack_record\n")
+
+	out, err := exec.Command("bash", "--norc", "-c", script.String()).Output()
+	if err != nil {
+		t.Fatalf("Failed to run the record hook: %v", err)
+	}
+	if got := string(out); got != "[ ls]" {
+		t.Errorf("Expected the command's leading space to reach record, got %q", got)
+	}
+}
+
+// openFixtureDatabase creates a database at the given schema version with one
+// recorded command. Version 0 is the unversioned schema from before
+// migrations were introduced.
+func openFixtureDatabase(t *testing.T, version int) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "fixture.db"))
+	if err != nil {
+		t.Fatalf("Failed to open fixture database: %v", err)
+	}
+
+	if version == 0 {
+		_, err = db.Exec(`
+		CREATE TABLE commands (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			timestamp DATETIME NOT NULL,
+			directory TEXT NOT NULL,
+			full_command TEXT NOT NULL
+		);
+		CREATE TABLE words (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			word TEXT NOT NULL UNIQUE
+		);
+		CREATE TABLE command_word_positions (
+			command_id INTEGER NOT NULL,
+			word_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			PRIMARY KEY (command_id, word_id, position)
+		);`)
+	} else {
+		err = migrateDatabaseTo(db, version)
+	}
+	if err != nil {
+		t.Fatalf("Failed to create fixture schema v%d: %v", version, err)
+	}
+
+	_, err = db.Exec("INSERT INTO commands (timestamp, directory, full_command) VALUES (?, ?, ?)", time.Now(), "/tmp", "make test")
+	if err != nil {
+		t.Fatalf("Failed to insert fixture data v%d: %v", version, err)
+	}
+	return db
+}
+
+func TestMigrations(t *testing.T) {
+	for version := 0; version <= latestSchemaVersion(); version++ {
+		db := openFixtureDatabase(t, version)
+
+		if err := migrateDatabase(db); err != nil {
+			t.Fatalf("Failed to migrate from v%d: %v", version, err)
+		}
+
+		got, err := schemaVersion(db)
+		if err != nil {
+			t.Fatalf("Failed to read schema version: %v", err)
+		}
+		if got != latestSchemaVersion() {
+			t.Errorf("Migrating from v%d: expected version %d, got %d", version, latestSchemaVersion(), got)
+		}
+
+		var command string
+		if err := db.QueryRow("SELECT full_command FROM commands").Scan(&command); err != nil || command != "make test" {
+			t.Errorf("Migrating from v%d lost data: %q, %v", version, command, err)
+		}
+
+		// Running the migrations again must be a no-op
+		if err := migrateDatabase(db); err != nil {
+			t.Errorf("Re-running migrations from v%d failed: %v", version, err)
+		}
+		db.Close()
+	}
+
+	// A database from a newer release must be refused
+	db := openFixtureDatabase(t, latestSchemaVersion())
+	defer db.Close()
+	db.Exec(fmt.Sprintf("PRAGMA user_version = %d", latestSchemaVersion()+1))
+	if err := migrateDatabase(db); err == nil {
+		t.Error("Expected an error migrating a newer database")
+	}
+}
+
+func TestDoctorRepair(t *testing.T) {
+	app := newTestApp(t)
+	db := app.db
+
+	app.recordCommand(nil, []string{"docker", "compose", "up"})
+
+	// Break the word links of the command and leave an unused word behind
+	db.Exec("DELETE FROM command_word_positions WHERE position = 1")
+	db.Exec("INSERT INTO words (word) VALUES ('orphan')")
+
+	// Leave a run of a command that no longer exists
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get a connection: %v", err)
+	}
+	conn.ExecContext(context.Background(), "PRAGMA foreign_keys = OFF")
+	conn.ExecContext(context.Background(), "INSERT INTO runs (command_id, timestamp, directory) VALUES (999, ?, '/tmp')", time.Now())
+	conn.ExecContext(context.Background(), "PRAGMA foreign_keys = ON")
+	conn.Close()
+
+	report, err := app.checkDatabase()
+	if err != nil {
+		t.Fatalf("Failed to check database: %v", err)
+	}
+	if len(report.StaleCommands) != 1 || report.OrphanWords != 2 || len(report.ForeignKeys) != 1 || report.ForeignKeys[0].Table != "runs" {
+		t.Fatalf("Expected 1 stale command, 2 orphaned words and an orphaned run, got %+v", report)
+	}
+
+	if err := app.repairDatabase(report); err != nil {
+		t.Fatalf("Failed to repair database: %v", err)
+	}
+
+	report, err = app.checkDatabase()
+	if err != nil {
+		t.Fatalf("Failed to re-check database: %v", err)
+	}
+	if !report.healthy() {
+		t.Errorf("Expected a healthy database after repair, got %+v", report)
+	}
+
+	words, _ := app.loadCommandWords(1)
+	if len(words) != 3 || words[1] != "compose" {
+		t.Errorf("Expected word links to be rebuilt, got %v", words)
+	}
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	tempDir := t.TempDir()
+	app := newTestApp(t)
+	db := app.db
+
+	app.recordCommand(nil, []string{"make", "build"})
+
+	backupPath := filepath.Join(tempDir, "backups", "bashtrack.db.gz")
+	if err := app.writeBackup(backupPath, true); err != nil {
+		t.Fatalf("Failed to write backup: %v", err)
+	}
+	if gzipped, _ := isGzipFile(backupPath); !gzipped {
+		t.Error("Expected a gzip compressed backup")
+	}
+
+	// Backups hold the whole history, so only the owner may read them
+	plainPath := filepath.Join(tempDir, "backups", "plain.db")
+	os.WriteFile(plainPath, nil, 0644)
+	if err := app.writeBackup(plainPath, false); err != nil {
+		t.Fatalf("Failed to write uncompressed backup: %v", err)
+	}
+	for _, path := range []string{backupPath, plainPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Failed to stat backup: %v", err)
+		}
+		if info.Mode().Perm() != backupFileMode {
+			t.Errorf("Expected %s to be private, got %v", path, info.Mode().Perm())
+		}
+	}
+
+	// Rotating keeps the previous backup under a numbered name
+	if err := rotateBackups(backupPath, 2); err != nil {
+		t.Fatalf("Failed to rotate backups: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "backups", "bashtrack.db.1.gz")); err != nil {
+		t.Errorf("Expected rotated backup: %v", err)
+	}
+	backupPath = filepath.Join(tempDir, "backups", "bashtrack.db.1.gz")
+
+	app.recordCommand(nil, []string{"make", "clean"})
+
+	if err := app.restoreFrom(backupPath); err != nil {
+		t.Fatalf("Failed to restore backup: %v", err)
+	}
+
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM commands").Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected 1 command after restore, got %d", count)
+	}
+
+	// Files that aren't bashtrack databases are refused
+	bogus := filepath.Join(tempDir, "bogus.db")
+	os.WriteFile(bogus, []byte("not a database"), 0644)
+	if err := app.restoreFrom(bogus); err == nil {
+		t.Error("Expected restoring a bogus file to fail")
+	}
+}
+
+func TestFileSync(t *testing.T) {
+	syncDir := t.TempDir()
+
+	newHost := func(name string) *App {
+		app := newTestApp(t)
+		app.config.Sync = SyncConfig{Dir: syncDir, Host: name}
+		return app
+	}
+
+	laptop := newHost("laptop")
+	vm := newHost("vm")
+
+	laptop.recordCommand(nil, []string{"make", "deploy"})
+	laptop.recordCommand(nil, []string{"git", "pull"})
+	vm.recordCommand(nil, []string{"git", "pull"})
+
+	if n, err := laptop.exportChangelog(syncDir); err != nil || n != 2 {
+		t.Fatalf("Expected 2 exported entries, got %d (%v)", n, err)
+	}
+	if n, err := vm.exportChangelog(syncDir); err != nil || n != 1 {
+		t.Fatalf("Expected 1 exported entry, got %d (%v)", n, err)
+	}
+
+	// Merging twice must give the same result
+	for i := 0; i < 2; i++ {
+		if _, err := vm.importChangelogs(syncDir); err != nil {
+			t.Fatalf("Failed to import changelogs: %v", err)
+		}
+		vm.db.Exec("DELETE FROM sync_state WHERE source NOT LIKE 'export:%'")
+	}
+
+	var count int
+	vm.db.QueryRow("SELECT COUNT(*) FROM commands").Scan(&count)
+	if count != 2 {
+		t.Errorf("Expected 2 commands on vm after merge, got %d", count)
+	}
+
+	var host string
+	vm.db.QueryRow("SELECT host FROM commands WHERE full_command = 'make deploy'").Scan(&host)
+	if host != "laptop" {
+		t.Errorf("Expected merged command to keep its host, got %q", host)
+	}
+
+	// Merged commands are not echoed back into the vm's own changelog
+	if n, _ := vm.exportChangelog(syncDir); n != 0 {
+		t.Errorf("Expected nothing new to export, got %d", n)
+	}
+
+	// Runs merged into an existing command count towards its runs
+	laptop.recordCommand(nil, []string{"make", "deploy"})
+	laptop.exportChangelog(syncDir)
+	if _, err := vm.importChangelogs(syncDir); err != nil {
+		t.Fatalf("Failed to import changelogs: %v", err)
+	}
+	var runCount, runs int
+	vm.db.QueryRow("SELECT run_count, (SELECT COUNT(*) FROM runs WHERE command_id = c.id) FROM commands c WHERE full_command = 'make deploy'").Scan(&runCount, &runs)
+	if runCount != 2 || runs != 2 {
+		t.Errorf("Expected 2 runs of the merged command, got run_count %d and %d runs", runCount, runs)
+	}
+}
+
+func TestRemoteSync(t *testing.T) {
+	serverDB, err := openSyncServerDatabase(filepath.Join(t.TempDir(), "server.db"))
+	if err != nil {
+		t.Fatalf("Failed to open server database: %v", err)
+	}
+	defer serverDB.Close()
+
+	server := httptest.NewServer(&syncServer{db: serverDB, token: "s3cret"})
+	defer server.Close()
+
+	t.Setenv(syncTokenEnv, "s3cret")
+	t.Setenv(syncPassphraseEnv, "correct horse battery staple")
+
+	newHost := func(name string) (*App, *syncClient) {
+		app := newTestApp(t)
+		app.config.Sync = SyncConfig{Host: name}
+		client, err := app.newSyncClient(server.URL)
+		if err != nil {
+			t.Fatalf("Failed to create sync client: %v", err)
+		}
+		return app, client
+	}
+
+	laptop, laptopClient := newHost("laptop")
+	vm, vmClient := newHost("vm")
+
+	laptop.recordCommand(nil, []string{"kubectl", "get", "pods"})
+	if n, err := laptop.pushRemote(laptopClient); err != nil || n != 1 {
+		t.Fatalf("Expected 1 pushed entry, got %d (%v)", n, err)
+	}
+	// Nothing new is pushed twice
+	if n, _ := laptop.pushRemote(laptopClient); n != 0 {
+		t.Errorf("Expected no entries on second push, got %d", n)
+	}
+
+	var payload string
+	serverDB.QueryRow("SELECT payload FROM entries").Scan(&payload)
+	if strings.Contains(payload, "kubectl") {
+		t.Error("Expected the server to only store encrypted commands")
+	}
+
+	if n, err := vm.pullRemote(vmClient); err != nil || n != 1 {
+		t.Fatalf("Expected 1 merged entry, got %d (%v)", n, err)
+	}
+	var command string
+	vm.db.QueryRow("SELECT full_command FROM commands").Scan(&command)
+	if command != "kubectl get pods" {
+		t.Errorf("Expected pulled command to be decrypted, got %q", command)
+	}
+
+	// Payloads without their key salt are rejected
+	if _, err := vmClient.open(remoteEntry{Payload: payload[strings.Index(payload, syncSaltSeparator)+1:]}); err == nil {
+		t.Error("Expected a payload without a salt to be rejected")
+	}
+
+	// Wrong tokens are rejected
+	vmClient.token = "wrong"
+	if _, err := vm.pullRemote(vmClient); err == nil {
+		t.Error("Expected an error with a wrong token")
+	}
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	tempDir := t.TempDir()
+	app := newTestApp(t)
+	db := app.db
+	app.recordCommand(nil, []string{"ssh", "prod-db.internal"})
+
+	cfg := EncryptionConfig{Enabled: true, KeyFile: filepath.Join(tempDir, "key")}
+	if err := app.encryptDatabase(cfg); err != nil {
+		t.Fatalf("Failed to encrypt database: %v", err)
+	}
+	app.recordCommand(nil, []string{"kubectl", "get", "pods"})
+	app.recordCommand(nil, []string{"ssh", "prod-db.internal"})
+
+	// Nothing is stored in plaintext
+	for _, query := range []string{
+		"SELECT full_command FROM commands",
+		"SELECT directory FROM commands",
+		"SELECT word FROM words",
+	} {
+		rows, _ := db.Query(query)
+		for rows.Next() {
+			var value string
+			rows.Scan(&value)
+			if !strings.HasPrefix(value, encryptedPrefix) {
+				t.Errorf("%s: expected encrypted value, got %q", query, value)
+			}
+		}
+		rows.Close()
+	}
+
+	// Encrypting again, as after an interrupted enable, leaves sealed values alone
+	if err := app.encryptDatabase(cfg); err != nil {
+		t.Fatalf("Failed to resume encryption: %v", err)
+	}
+
+	// Deduplication still works on encrypted commands
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM commands").Scan(&count)
+	if count != 2 {
+		t.Errorf("Expected 2 commands after dedup, got %d", count)
+	}
+
+	commands, err := app.queryCommands(commandQuery{Filter: "PROD", Limit: 10})
+	if err != nil {
+		t.Fatalf("Failed to search: %v", err)
+	}
+	if len(commands) != 1 || commands[0].Command != "ssh prod-db.internal" {
+		t.Errorf("Expected to find the decrypted ssh command, got %+v", commands)
+	}
+	if len(commands) == 1 && strings.Join(commands[0].Words, " ") != "ssh prod-db.internal" {
+		t.Errorf("Expected decrypted words, got %v", commands[0].Words)
+	}
+
+	if report, err := app.checkDatabase(); err != nil || len(report.StaleCommands) != 0 {
+		t.Errorf("Expected no stale word links, got %v (%v)", report, err)
+	}
+
+	// The key is checked against the database
+	if _, err := loadFieldCipher(cfg, db); err != nil {
+		t.Errorf("Expected the key to load, got %v", err)
+	}
+	os.WriteFile(cfg.KeyFile, []byte("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\n"), 0600)
+	if _, err := loadFieldCipher(cfg, db); err == nil {
+		t.Error("Expected a wrong key to be rejected")
+	}
+
+	if err := app.decryptDatabase(); err != nil {
+		t.Fatalf("Failed to decrypt database: %v", err)
+	}
+	var command string
+	db.QueryRow("SELECT full_command FROM commands ORDER BY id LIMIT 1").Scan(&command)
+	if command != "ssh prod-db.internal" {
+		t.Errorf("Expected decrypted command, got %q", command)
+	}
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	app := newTestApp(t)
+	db := app.db
+	now := time.Now()
+	insert := func(command string, age time.Duration, runs int) {
+		_, err := db.Exec("INSERT INTO commands (timestamp, directory, full_command, run_count) VALUES (?, ?, ?, ?)",
+			now.Add(-age), "/tmp", command, runs)
+		if err != nil {
+			t.Fatalf("Failed to insert %q: %v", command, err)
+		}
+	}
+	day := 24 * time.Hour
+	insert("kubectl get pods", 40*day, 1) // past its pattern TTL
+	insert("kubectl logs api", 10*day, 1) // within its TTL, but oldest beyond max rows
+	insert("make build", 400*day, 1)      // past max age
+	insert("make deploy", 400*day, 50)    // kept as frequently used
+	insert("go test ./...", 3*day, 1)
+	insert("git status", 2*day, 1)
+	insert("git push", 1*day, 1)
+
+	policy := RetentionConfig{
+		MaxAgeDays:   365,
+		MaxRows:      4,
+		TTLs:         []PatternTTL{{Pattern: "^kubectl", Days: 30}},
+		KeepFrequent: 20,
+	}
+	matches, err := app.findRetentionMatches(policy, now)
+	if err != nil {
+		t.Fatalf("Failed to evaluate policy: %v", err)
+	}
+
+	var removed []string
+	for _, m := range matches {
+		removed = append(removed, m.Entry.Command)
+	}
+	expected := []string{"kubectl get pods", "make build", "kubectl logs api"}
+	if strings.Join(removed, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v to be removed, got %v", expected, removed)
+	}
+
+	// Runs are counted across deduplicated records
+	app.recordCommand(nil, []string{"echo", "hi"})
+	app.recordCommand(nil, []string{"echo", "hi"})
+	var runs int
+	db.QueryRow("SELECT run_count FROM commands WHERE full_command = 'echo hi'").Scan(&runs)
+	if runs != 2 {
+		t.Errorf("Expected run_count 2, got %d", runs)
+	}
+
+	// The automatic check applies the age and row limits in SQL, keeping
+	// anything a TTL would keep longer
+	ids, err := app.dueRetentionIDs(policy, now)
+	if err != nil {
+		t.Fatalf("Failed to select due commands: %v", err)
+	}
+	if len(ids) != 4 {
+		t.Errorf("Expected 4 commands due (8 recorded, 1 kept, max 4), got %v", ids)
+	}
+
+	policy.CheckEvery = 3
+	app.config.Retention = policy
+	app.recordCommand(nil, []string{"ls", "-la"})
+	app.recordCommand(nil, []string{"pwd"})
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM commands").Scan(&count)
+	if count != 10 {
+		t.Errorf("Expected no retention before the third command, got %d commands", count)
+	}
+	app.recordCommand(nil, []string{"whoami"})
+	db.QueryRow("SELECT COUNT(*) FROM commands").Scan(&count)
+	if count != 4 {
+		t.Errorf("Expected retention to leave 4 commands, got %d", count)
+	}
+}
+
+func TestCleanupSelectionAndTrash(t *testing.T) {
+	app := newTestApp(t)
+	app.config.Retention = RetentionConfig{TrashDays: 7}
+	db := app.db
+	now := time.Now()
+	for _, c := range []struct{ command, dir, host string }{
+		{"make build", "/src/app", "laptop"},
+		{"make test", "/src/app/sub", "vm"},
+		{"make build", "/src/application", "laptop"},
+		{"git status", "/src/app", "laptop"},
+	} {
+		_, err := db.Exec("INSERT INTO commands (timestamp, directory, full_command, host) VALUES (?, ?, ?, ?)",
+			now, c.dir, c.command+" "+c.dir, c.host)
+		if err != nil {
+			t.Fatalf("Failed to insert command: %v", err)
+		}
+	}
+
+	sel := cleanupSelection{directory: "/src/app", pattern: regexp.MustCompile("^make"), host: "laptop"}
+	matches, err := app.selectCommands(sel)
+	if err != nil {
+		t.Fatalf("Failed to select commands: %v", err)
+	}
+	if len(matches) != 1 || matches[0].Entry.Command != "make build /src/app" {
+		t.Fatalf("Expected only 'make build' in /src/app on laptop, got %+v", matches)
+	}
+
+	if before, _ := parseTimeFlag("30d", now); !before.Equal(now.AddDate(0, 0, -30)) {
+		t.Errorf("Expected 30d to be 30 days ago, got %v", before)
+	}
+
+	if n, err := app.trashCommands(retentionIDs(matches)); err != nil || n != 1 {
+		t.Fatalf("Expected 1 trashed command, got %d (%v)", n, err)
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM commands").Scan(&count)
+	if count != 3 {
+		t.Errorf("Expected 3 commands after cleanup, got %d", count)
+	}
+
+	if n, err := app.restoreTrash(0); err != nil || n != 1 {
+		t.Fatalf("Expected 1 restored command, got %d (%v)", n, err)
+	}
+	db.QueryRow("SELECT COUNT(*) FROM commands").Scan(&count)
+	if count != 4 {
+		t.Errorf("Expected 4 commands after restore, got %d", count)
+	}
+	if words, _ := app.loadCommandWords(matches[0].Entry.ID); len(words) != 3 {
+		t.Errorf("Expected restored command to have its words back, got %v", words)
+	}
+
+	// Annotations go to the trash and come back with the command
+	id := matches[0].Entry.ID
+	db.Exec("INSERT INTO tags (command_id, tag) VALUES (?, 'ci')", id)
+	db.Exec("INSERT INTO notes (command_id, note, updated_at) VALUES (?, 'slow', ?)", id, now)
+	app.trashCommands([]int{id})
+	db.QueryRow("SELECT (SELECT COUNT(*) FROM trash_tags) + (SELECT COUNT(*) FROM trash_notes)").Scan(&count)
+	if count != 2 {
+		t.Errorf("Expected the tag and note in the trash, got %d rows", count)
+	}
+	app.restoreTrash(0)
+	restored := Command{ID: id}
+	app.loadAnnotations(&restored)
+	if strings.Join(restored.Tags, ",") != "ci" || restored.Note != "slow" {
+		t.Errorf("Expected restored annotations, got %+v", restored)
+	}
+	db.QueryRow("SELECT (SELECT COUNT(*) FROM trash_tags) + (SELECT COUNT(*) FROM trash_notes)").Scan(&count)
+	if count != 0 {
+		t.Errorf("Expected no annotations left in the trash, got %d rows", count)
+	}
+
+	// Forgetting reaches into the trash, where secrets would otherwise linger
+	app.trashCommands(retentionIDs(matches))
+	forgotten, _ := app.findCommandsToForget("^make build /src/app$", 0)
+	if len(forgotten) != 1 {
+		t.Fatalf("Expected forget to find the trashed command, got %+v", forgotten)
+	}
+	app.purgeCommands([]int{forgotten[0].ID})
+	db.QueryRow("SELECT COUNT(*) FROM trash").Scan(&count)
+	if count != 0 {
+		t.Errorf("Expected trash to be empty after forget, got %d", count)
+	}
+}
+
+func TestStarsTagsAndNotes(t *testing.T) {
+	app := newTestApp(t)
+	db := app.db
+	old := time.Now().AddDate(0, 0, -400)
+	for _, command := range []string{"helm upgrade prod ./chart", "make build"} {
+		if _, err := db.Exec("INSERT INTO commands (timestamp, directory, full_command) VALUES (?, ?, ?)", old, "/src", command); err != nil {
+			t.Fatalf("Failed to insert command: %v", err)
+		}
+	}
+
+	starCmd := &cobra.Command{}
+	starCmd.Flags().Bool("remove", false, "")
+	app.starCommands(starCmd, []string{"1"})
+
+	tagCmd := &cobra.Command{}
+	tagCmd.Flags().Bool("remove", false, "")
+	app.tagCommand(tagCmd, []string{"1", "deploy", "prod"})
+
+	noteCmd := &cobra.Command{}
+	noteCmd.Flags().Bool("clear", false, "")
+	app.noteCommand(noteCmd, []string{"1", "needs", "VPN"})
+
+	commands, err := app.queryCommands(commandQuery{Tag: "deploy", Limit: 10})
+	if err != nil || len(commands) != 1 {
+		t.Fatalf("Expected one command tagged deploy, got %+v (%v)", commands, err)
+	}
+	c := commands[0]
+	if !c.Starred || strings.Join(c.Tags, ",") != "deploy,prod" || c.Note != "needs VPN" {
+		t.Errorf("Expected annotations to be loaded, got %+v", c)
+	}
+
+	if commands, _ := app.queryCommands(commandQuery{Starred: true, Limit: 10}); len(commands) != 1 {
+		t.Errorf("Expected one starred command, got %d", len(commands))
+	}
+
+	// Starred commands survive cleanup
+	matches, err := app.findRetentionMatches(RetentionConfig{MaxAgeDays: 30}, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to evaluate policy: %v", err)
+	}
+	if len(matches) != 1 || matches[0].Entry.Command != "make build" {
+		t.Errorf("Expected only the unstarred command to be removed, got %+v", matches)
+	}
+
+	// Annotations go away with their command
+	app.purgeCommands([]int{1})
+	var count int
+	db.QueryRow("SELECT (SELECT COUNT(*) FROM stars) + (SELECT COUNT(*) FROM tags) + (SELECT COUNT(*) FROM notes)").Scan(&count)
+	if count != 0 {
+		t.Errorf("Expected annotations to be deleted with the command, got %d rows", count)
+	}
+}
+
+func TestSnippets(t *testing.T) {
+	s := newSnippet("deploy-prod", "helm upgrade api ./chart --env=prod --namespace prod-api", map[string]string{"ns": "prod-api"})
+	if s.Template != "helm upgrade api ./chart --env={{env}} --namespace {{ns}}" {
+		t.Fatalf("Unexpected template %q", s.Template)
+	}
+
+	command, err := s.render(map[string]string{"env": "staging"})
+	if err != nil || command != "helm upgrade api ./chart --env=staging --namespace prod-api" {
+		t.Errorf("Expected defaults to fill the remaining placeholders, got %q (%v)", command, err)
+	}
+
+	// Only whole words are replaced, in place, and never inside a placeholder
+	s = newSnippet("grep", `grep -r  "api"   --include=api.go api-server api`, map[string]string{"name": "api"})
+	if s.Template != `grep -r  "{{name}}"   --include={{include}} api-server {{name}}` {
+		t.Errorf("Unexpected template %q", s.Template)
+	}
+
+	required := Snippet{Name: "ssh", Template: "ssh {{host}}"}
+	if _, err := required.render(nil); err == nil || !strings.Contains(err.Error(), "--host") {
+		t.Errorf("Expected an error naming the missing parameter, got %v", err)
+	}
+
+	// Snippets survive an export and import through the shareable file format
+	app := newTestApp(t)
+
+	data := []byte(`{"version": 1, "snippets": [` +
+		`{"name": "deploy-prod", "template": "helm upgrade --env={{env}}", "params": {"env": "prod"}},` +
+		`{"name": "ssh", "template": "ssh {{host}}"}]}`)
+	if imported, _, err := app.importSnippetData(data, false); err != nil || imported != 2 {
+		t.Fatalf("Expected 2 imported snippets, got %d (%v)", imported, err)
+	}
+	if imported, skipped, _ := app.importSnippetData(data, false); imported != 0 || skipped != 2 {
+		t.Errorf("Expected existing snippets to be skipped, got %d imported, %d skipped", imported, skipped)
+	}
+
+	loaded, err := app.loadSnippet("deploy-prod")
+	if err != nil || loaded.Params["env"] != "prod" {
+		t.Errorf("Expected the imported snippet with its default, got %+v (%v)", loaded, err)
+	}
+
+	// Saving over an existing snippet needs --overwrite
+	app.recordCommand(nil, []string{"ssh", "bastion"})
+	saveCmd := &cobra.Command{}
+	saveCmd.Flags().String("name", "ssh", "")
+	saveCmd.Flags().String("description", "", "")
+	saveCmd.Flags().StringArray("param", nil, "")
+	saveCmd.Flags().Bool("overwrite", false, "")
+	app.saveSnippetFromCommand(saveCmd, []string{"1"})
+	if loaded, _ := app.loadSnippet("ssh"); loaded.Template != "ssh {{host}}" {
+		t.Errorf("Expected the existing snippet to be kept, got %q", loaded.Template)
+	}
+	saveCmd.Flags().Set("overwrite", "true")
+	app.saveSnippetFromCommand(saveCmd, []string{"1"})
+	if loaded, _ := app.loadSnippet("ssh"); loaded.Template != "ssh bastion" {
+		t.Errorf("Expected --overwrite to replace the snippet, got %q", loaded.Template)
+	}
+}
+
+func TestCommandContext(t *testing.T) {
+	app := newTestApp(t)
+	db := app.db
+	record := func(session, command string) {
+		t.Setenv(sessionEnv, session)
+		app.recordCommand(nil, strings.Fields(command))
+	}
+	record("a", "git pull")
+	record("a", "make build")
+	record("b", "vim notes.txt")
+	record("a", "make test")
+	record("a", "git pull") // a re-run is a new run, not an overwrite
+	record("a", "git push")
+
+	var buildID int
+	db.QueryRow("SELECT id FROM commands WHERE full_command = 'make build'").Scan(&buildID)
+
+	before, target, after, err := app.runContext(buildID, 2)
+	if err != nil {
+		t.Fatalf("Failed to load context: %v", err)
+	}
+	names := func(runs []commandRun) string {
+		var out []string
+		for _, r := range runs {
+			out = append(out, r.command)
+		}
+		return strings.Join(out, ", ")
+	}
+	if names(before) != "git pull" || target.command != "make build" || names(after) != "make test, git pull" {
+		t.Errorf("Unexpected context: before [%s], target %q, after [%s]", names(before), target.command, names(after))
+	}
+
+	var runs int
+	db.QueryRow("SELECT COUNT(*) FROM runs").Scan(&runs)
+	if runs != 6 {
+		t.Errorf("Expected 6 runs, got %d", runs)
+	}
+
+	// A run merged later with an earlier timestamp is ordered by time, not ID
+	var pullID int
+	db.QueryRow("SELECT id FROM commands WHERE full_command = 'git pull'").Scan(&pullID)
+	var first time.Time
+	db.QueryRow("SELECT MIN(timestamp) FROM runs").Scan(&first)
+	var mergedID int64
+	db.QueryRow("SELECT id FROM commands WHERE full_command = 'vim notes.txt'").Scan(&mergedID)
+	db.Exec("INSERT INTO runs (command_id, session, timestamp, directory) VALUES (?, 'a', ?, '/tmp')", mergedID, first.Add(-time.Second))
+	if before, _, _, _ := app.runContext(buildID, 5); names(before) != "vim notes.txt, git pull" {
+		t.Errorf("Expected the merged run first, got [%s]", names(before))
+	}
+
+	// Sending the same history entry again, as an empty Enter does, is skipped
+	recordCmd := &cobra.Command{}
+	recordCmd.Flags().Int("exit-code", 0, "")
+	recordCmd.Flags().Int("history-id", 0, "")
+	recordCmd.Flags().Set("history-id", "42")
+	t.Setenv(sessionEnv, "c")
+	app.recordCommand(recordCmd, []string{"make", "lint"})
+	app.recordCommand(recordCmd, []string{"make", "lint"})
+	var lintRuns int
+	db.QueryRow("SELECT run_count FROM commands WHERE full_command = 'make lint'").Scan(&lintRuns)
+	if lintRuns != 1 {
+		t.Errorf("Expected the re-sent history entry to be skipped, got %d runs", lintRuns)
+	}
+	recordCmd.Flags().Set("history-id", "43")
+	app.recordCommand(recordCmd, []string{"make", "lint"})
+	db.QueryRow("SELECT run_count FROM commands WHERE full_command = 'make lint'").Scan(&lintRuns)
+	if lintRuns != 2 {
+		t.Errorf("Expected a new history entry to be recorded, got %d runs", lintRuns)
+	}
+
+	// Old runs age out, except the latest of each command
+	db.Exec("UPDATE runs SET timestamp = ?", time.Now().AddDate(0, 0, -400))
+	if _, err := app.pruneRuns(RetentionConfig{MaxAgeDays: 365}, time.Now(), 0); err != nil {
+		t.Fatalf("Failed to prune runs: %v", err)
+	}
+	var commands int
+	db.QueryRow("SELECT COUNT(*) FROM runs").Scan(&runs)
+	db.QueryRow("SELECT COUNT(*) FROM commands").Scan(&commands)
+	if runs != commands {
+		t.Errorf("Expected one run per command (%d) to be kept, got %d", commands, runs)
+	}
+}
+
+func TestSuggestNext(t *testing.T) {
+	app := newTestApp(t)
+	t.Setenv(sessionEnv, "s1")
+	for i := 0; i < 3; i++ {
+		app.recordCommand(nil, []string{"git", "add", "."})
+		app.recordCommand(nil, []string{"git", "commit"})
+	}
+	app.recordCommand(nil, []string{"git", "add", "."})
+	app.recordCommand(nil, []string{"make", "test"})
+
+	lastID, err := app.lastCommandID("git add .")
+	if err != nil || lastID == 0 {
+		t.Fatalf("Failed to find last command: %d (%v)", lastID, err)
+	}
+	wd, _ := os.Getwd()
+	suggestions, err := app.suggestNext(lastID, wd, time.Now(), 3)
+	if err != nil {
+		t.Fatalf("Failed to suggest: %v", err)
+	}
+	if len(suggestions) < 2 || suggestions[0].Command != "git commit" || suggestions[1].Command != "make test" {
+		t.Errorf("Expected 'git commit' then 'make test', got %+v", suggestions)
+	}
+	for _, s := range suggestions {
+		if s.Command == "git add ." {
+			t.Error("Expected the last command not to be suggested again")
+		}
+	}
+
+	// The session's latest run is the default starting point
+	if id, _ := app.lastCommandID(""); id == 0 {
+		t.Error("Expected the session's last command to be found")
+	}
+}
+
+func TestHistoryCompletions(t *testing.T) {
+	app := newTestApp(t)
+	app.recordCommand(nil, []string{"kubectl", "-n", "staging", "get", "pods"})
+	app.recordCommand(nil, []string{"kubectl", "-n", "prod", "get", "pods"})
+	app.recordCommand(nil, []string{"kubectl", "-n", "prod", "logs", "api"})
+	app.recordCommand(nil, []string{"kubectl", "-n", "prod", "logs", "api"})
+
+	// Words after the same program and previous word, most run first
+	got, err := app.historyCompletions([]string{"kubectl", "-n"}, "")
+	if err != nil {
+		t.Fatalf("Failed to complete: %v", err)
+	}
+	if strings.Join(got, ",") != "prod,staging" {
+		t.Errorf("Expected prod,staging, got %v", got)
+	}
+
+	got, _ = app.historyCompletions([]string{"kubectl", "-n"}, "st")
+	if strings.Join(got, ",") != "staging" {
+		t.Errorf("Expected the prefix to filter candidates, got %v", got)
+	}
+
+	// An unseen previous word falls back to the position alone
+	got, _ = app.historyCompletions([]string{"kubectl", "-n", "dev"}, "")
+	if strings.Join(got, ",") != "get,logs" {
+		t.Errorf("Expected get,logs as a fallback, got %v", got)
+	}
+
+	if got, _ = app.historyCompletions([]string{"helm"}, ""); len(got) != 0 {
+		t.Errorf("Expected no completions for an unknown program, got %v", got)
+	}
+}
+
+func TestAliasSuggestions(t *testing.T) {
+	app := newTestApp(t)
+	for i := 0; i < 4; i++ {
+		app.recordCommand(nil, []string{"docker", "compose", "up", "-d"})
+		app.recordCommand(nil, []string{"kubectl", "-n", "prod", "get", "pods"})
+		app.recordCommand(nil, []string{"kubectl", "-n", "staging", "get", "pods"})
+	}
+	app.recordCommand(nil, []string{"docker", "compose", "logs", "-f"})
+
+	existing := parseAliases(strings.NewReader("alias dcl='docker compose logs -f'  # logs\nalias x=\"echo 'hi'\"\n"))
+	if len(existing) != 2 || existing[0].Expansion != "docker compose logs -f" || existing[1].Expansion != "echo 'hi'" {
+		t.Fatalf("Unexpected parsed aliases: %+v", existing)
+	}
+
+	suggestions, err := app.findAliasSuggestions(3, 12, existing)
+	if err != nil {
+		t.Fatalf("Failed to suggest aliases: %v", err)
+	}
+	found := map[string]aliasSuggestion{}
+	for _, s := range suggestions {
+		found[s.Expansion] = s
+		if s.Name == "dcl" {
+			t.Errorf("Expected existing alias names to be avoided, got %+v", s)
+		}
+	}
+	if s, ok := found["docker compose up -d"]; !ok || s.Runs != 4 || s.Saved != (20-len(s.Name))*4 {
+		t.Errorf("Expected an alias for the repeated command, got %+v", s)
+	}
+	if s, ok := found["docker compose"]; !ok || s.Runs != 5 {
+		t.Errorf("Expected an alias for the common prefix, got %+v", s)
+	}
+	if s, ok := found[`kubectl -n "$1" get pods`]; !ok || !s.Function || s.Runs != 8 {
+		t.Errorf("Expected a function for the varying namespace, got %+v", s)
+	}
+	if _, ok := found["docker compose logs -f"]; ok {
+		t.Error("Expected commands covered by an alias not to be suggested again")
+	}
+
+	// Written suggestions read back as existing aliases
+	file := filepath.Join(t.TempDir(), "aliases.sh")
+	if n, err := writeAliases(file, suggestions); err != nil || n != len(suggestions) {
+		t.Fatalf("Failed to write aliases: %d (%v)", n, err)
+	}
+	if n, _ := writeAliases(file, suggestions); n != 0 {
+		t.Errorf("Expected defined names to be skipped, wrote %d", n)
+	}
+	data, _ := os.ReadFile(file)
+	if written := parseAliases(strings.NewReader(string(data))); len(written) != len(suggestions) {
+		t.Errorf("Expected %d aliases in the file, got %+v", len(suggestions), written)
+	}
+
+	a, ok := coveringAlias("docker compose logs -f api", existing)
+	if !ok || a.Name != "dcl" {
+		t.Errorf("Expected dcl to cover the command, got %+v", a)
+	}
+	if _, ok := coveringAlias("docker compose logs -follow", existing); ok {
+		t.Error("Expected aliases to cover whole words only")
+	}
+}
+
+func TestTyposAndFailingCommands(t *testing.T) {
+	app := newTestApp(t)
+	app.config.Sync = SyncConfig{Host: "laptop"}
+	record := func(exitCode int, command string) {
+		recordCmd := &cobra.Command{}
+		recordCmd.Flags().Int("exit-code", 0, "")
+		recordCmd.Flags().Set("exit-code", strconv.Itoa(exitCode))
+		app.recordCommand(recordCmd, []string{command})
+	}
+	for i := 0; i < 5; i++ {
+		record(0, "git status")
+	}
+	record(127, "gti status")
+	record(127, "gti push")
+	record(1, "make test")
+	record(1, "make test")
+	record(0, "make test")
+	app.recordCommand(nil, []string{"mkae"}) // No exit code, not a failure
+
+	typos, err := app.findTypos(5)
+	if err != nil {
+		t.Fatalf("Failed to find typos: %v", err)
+	}
+	if len(typos) != 1 || typos[0].Word != "gti" || typos[0].Program != "git" || typos[0].Failures != 2 {
+		t.Errorf("Expected gti -> git with 2 failures, got %+v", typos)
+	}
+
+	wd, _ := os.Getwd()
+	failing, err := app.failingCommands(wd)
+	if err != nil {
+		t.Fatalf("Failed to find failing commands: %v", err)
+	}
+	if len(failing) != 3 || failing[0].Command != "make test" || failing[0].Failures != 2 || failing[0].Runs != 3 {
+		t.Errorf("Expected make test to fail most, got %+v", failing)
+	}
+
+	// list shows the exit code of the latest run
+	commands, err := app.queryCommands(commandQuery{Limit: 10})
+	if err != nil {
+		t.Fatalf("Failed to query commands: %v", err)
+	}
+	exitCodes := map[string]string{}
+	for _, c := range commands {
+		exitCodes[c.Command] = "-"
+		if c.ExitCode != nil {
+			exitCodes[c.Command] = strconv.Itoa(*c.ExitCode)
+		}
+	}
+	if exitCodes["make test"] != "0" || exitCodes["gti push"] != "127" || exitCodes["mkae"] != "-" {
+		t.Errorf("Unexpected exit codes: %v", exitCodes)
+	}
+	v := listView{compact: true, columns: []string{"host", "command"}, width: 80}
+	if got := v.cell(commands[0], "host"); got != "laptop" {
+		t.Errorf("Expected the host column to show the recording host, got %q", got)
+	}
+
+	csvCmd := &cobra.Command{}
+	csvCmd.Flags().String("output", outputCSV, "")
+	csvCmd.Flags().String("format", "", "")
+	out, err := rendererFromFlags(csvCmd)
+	if err != nil {
+		t.Fatalf("Failed to create renderer: %v", err)
+	}
+	var buf bytes.Buffer
+	out.w = &buf
+	if err := out.render(commandList(commands)); err != nil {
+		t.Fatalf("Failed to render CSV: %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil || len(records) < 2 || records[0][4] != "host" || records[1][4] != "laptop" {
+		t.Errorf("Expected the host in the CSV output, got %v (%v)", records, err)
+	}
+
+	if d := editDistance("gti", "git"); d != 1 {
+		t.Errorf("Expected a swap to be one edit, got %d", d)
+	}
+}
+
+func TestBuildActivity(t *testing.T) {
+	day := func(d, hour int) time.Time {
+		return time.Date(2026, time.March, d, hour, 0, 0, 0, time.Local)
+	}
+	// Monday 2 to Wednesday 4, a gap, then Saturday 7 and Sunday 8
+	times := []time.Time{day(2, 9), day(2, 9), day(3, 10), day(4, 23), day(7, 9), day(8, 9), day(8, 14)}
+	a := buildActivity(times, day(8, 20))
+
+	if a.Total != 7 || a.ActiveDays != 5 {
+		t.Errorf("Expected 7 runs on 5 days, got %d on %d", a.Total, a.ActiveDays)
+	}
+	if a.Heatmap[0][9] != 2 || a.Heatmap[6][14] != 1 || a.Heatmap[2][23] != 1 {
+		t.Errorf("Unexpected heatmap: %v", a.Heatmap)
+	}
+	if len(a.Daily) != 7 || a.Daily[3].Count != 0 || a.Daily[6].Count != 2 {
+		t.Errorf("Expected 7 days with the gap filled in, got %+v", a.Daily)
+	}
+	if len(a.Weekly) != 1 || a.Weekly[0].Count != 7 {
+		t.Errorf("Expected a single week, got %+v", a.Weekly)
+	}
+	if a.Busiest[0].Day != day(8, 0) || a.Busiest[0].Count != 2 {
+		t.Errorf("Expected the latest of the busiest days first, got %+v", a.Busiest[0])
+	}
+	if a.LongestStreak != 3 || !a.LongestEnd.Equal(day(4, 0)) || a.CurrentStreak != 2 {
+		t.Errorf("Expected streaks of 3 (ending 4th) and 2, got %d (%v) and %d", a.LongestStreak, a.LongestEnd, a.CurrentStreak)
+	}
+
+	// Yesterday's streak still counts until today is over
+	if a := buildActivity(times, day(9, 8)); a.CurrentStreak != 2 {
+		t.Errorf("Expected the streak to survive an idle morning, got %d", a.CurrentStreak)
+	}
+	if a := buildActivity(times, day(10, 8)); a.CurrentStreak != 0 {
+		t.Errorf("Expected the streak to end after an idle day, got %d", a.CurrentStreak)
+	}
+
+	// Runs only from a clock ahead of ours still leave today to show
+	if a := buildActivity(times, day(1, 8)); len(a.Daily) != 1 || len(a.Weekly) != 1 {
+		t.Errorf("Expected today alone when all runs are in the future, got %+v and %+v", a.Daily, a.Weekly)
+	}
+
+	if got := sparkline([]dayCount{{Count: 0}, {Count: 1}, {Count: 8}}); got != " ▁█" {
+		t.Errorf("Unexpected sparkline %q", got)
+	}
+}
+
+func TestScopedStatsAndProjects(t *testing.T) {
+	app := newTestApp(t)
+	db := app.db
+
+	root := t.TempDir()
+	api := filepath.Join(root, "api")
+	web := filepath.Join(root, "web")
+	for _, dir := range []string{filepath.Join(api, ".git"), filepath.Join(api, "cmd"), web} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(web, "package.json"), []byte("{}"), 0644)
+
+	now := time.Now()
+	for _, c := range []struct {
+		dir, command string
+		runs         int
+	}{
+		{api, "make test", 5},
+		{api, "git status", 2},
+		{filepath.Join(api, "cmd"), "go run .", 3},
+		{web, "npm start", 4},
+		{"/elsewhere", "make test", 1},
+		{web, "git status", 3},
+	} {
+		// Commands keep the directory of their first run
+		_, err := db.Exec("INSERT INTO commands (timestamp, directory, full_command) SELECT ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM commands WHERE full_command = ?)",
+			now, c.dir, c.command, c.command)
+		if err != nil {
+			t.Fatalf("Failed to insert command: %v", err)
+		}
+		for i := 0; i < c.runs; i++ {
+			_, err := db.Exec("INSERT INTO runs (command_id, timestamp, directory) SELECT id, ?, ? FROM commands WHERE full_command = ?",
+				now, c.dir, c.command)
+			if err != nil {
+				t.Fatalf("Failed to insert run: %v", err)
+			}
+		}
+	}
+
+	stats, err := app.collectStats(directoryScope{dir: api})
+	if err != nil {
+		t.Fatalf("Failed to collect stats: %v", err)
+	}
+	if stats.Total != 2 || len(stats.TopDirectories) != 1 {
+		t.Errorf("Expected 2 commands directly in api, got %+v", stats)
+	}
+	if stats, _ = app.collectStats(directoryScope{dir: api, recursive: true}); stats.Total != 3 || len(stats.TopDirectories) != 2 {
+		t.Errorf("Expected 3 commands in the api tree, got %+v", stats)
+	}
+	if stats, _ = app.collectStats(directoryScope{dir: web}); stats.Total != 2 || stats.TopCommands[0].Value != "npm start" {
+		t.Errorf("Expected runs in web to count there, got %+v", stats)
+	}
+	stats, err = app.collectStats(directoryScope{})
+	if err != nil {
+		t.Fatalf("Failed to aggregate stats: %v", err)
+	}
+	if stats.Total != 4 || len(stats.TopDirectories) != 4 || stats.TopCommands[0] != (countEntry{Value: "make test", Count: 6}) {
+		t.Errorf("Expected all 4 commands without a scope, got %+v", stats)
+	}
+	if !stats.Oldest.Equal(now) || !stats.Newest.Equal(now) {
+		t.Errorf("Expected the run times as the date range, got %v to %v", stats.Oldest, stats.Newest)
+	}
+
+	projects, err := app.collectProjects([]string{".git", "package.json"}, 1)
+	if err != nil {
+		t.Fatalf("Failed to collect projects: %v", err)
+	}
+	if len(projects) != 2 {
+		t.Fatalf("Expected 2 projects, got %+v", projects)
+	}
+	if p := projects[0]; p.Root != api || p.Runs != 10 || p.Commands != 3 || p.Directories != 2 ||
+		len(p.TopCommands) != 1 || p.TopCommands[0].Value != "make test" {
+		t.Errorf("Unexpected api project: %+v", p)
+	}
+	if p := projects[1]; p.Root != web || p.Runs != 7 || p.Commands != 2 {
+		t.Errorf("Unexpected web project: %+v", p)
+	}
+
+	if got, err := parseSQLiteTime("2026-03-02 09:00:00.5+01:00"); err != nil || !got.Equal(time.Date(2026, 3, 2, 8, 0, 0, 5e8, time.UTC)) {
+		t.Errorf("Expected an aggregated timestamp to parse, got %v (%v)", got, err)
+	}
+	if _, err := parseSQLiteTime("yesterday"); err == nil {
+		t.Error("Expected an unknown timestamp format to be an error")
+	}
+
+	t.Setenv("HOME", root)
+	scopeCmd := &cobra.Command{}
+	scopeCmd.Flags().String("dir", "~/api", "")
+	scopeCmd.Flags().Bool("recursive", false, "")
+	if scope, err := directoryScopeFromFlags(scopeCmd); err != nil || scope.dir != api {
+		t.Errorf("Expected ~ to expand to the home directory, got %q (%v)", scope.dir, err)
+	}
+}
+
+func TestRenderer(t *testing.T) {
+	commands := commandList{
+		{ID: 2, Timestamp: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), Command: `echo "a,b"`, Directory: "/src", Tags: []string{"x", "y"}},
+		{ID: 1, Timestamp: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), Command: "make", Directory: "/src"},
+	}
+	render := func(format, tmpl string, v interface{}) string {
+		cmd := &cobra.Command{}
+		cmd.Flags().String("output", format, "")
+		cmd.Flags().String("format", tmpl, "")
+		r, err := rendererFromFlags(cmd)
+		if err != nil {
+			t.Fatalf("Failed to create renderer: %v", err)
+		}
+		var buf bytes.Buffer
+		r.w = &buf
+		if err := r.render(v); err != nil {
+			t.Fatalf("Failed to render %s: %v", format, err)
+		}
+		return buf.String()
+	}
+
+	var decoded []Command
+	if err := json.Unmarshal([]byte(render(outputJSON, "", commands)), &decoded); err != nil || len(decoded) != 2 || decoded[0].Command != `echo "a,b"` {
+		t.Errorf("Expected the commands back from JSON, got %+v (%v)", decoded, err)
+	}
+	if got := render(outputJSON, "", commandList(nil)); strings.TrimSpace(got) != "[]" {
+		t.Errorf("Expected an empty array, got %q", got)
+	}
+	if got := render(outputNDJSON, "", commands); strings.Count(got, "\n") != 2 || !strings.HasPrefix(got, `{"id":2,`) {
+		t.Errorf("Expected one JSON object per line, got %q", got)
+	}
+
+	csvOut := render(outputCSV, "", commands)
+	if !strings.HasPrefix(csvOut, "id,timestamp,directory,command,") || !strings.Contains(csvOut, `2,2026-01-02T03:04:05Z,/src,"echo ""a,b""",,false,x;y,`) {
+		t.Errorf("Unexpected CSV: %q", csvOut)
+	}
+	if got := render(outputTSV, "", commandStats{Total: 0}); got != "section\tvalue\tcount\ntotal\t\t0\n" {
+		t.Errorf("Unexpected TSV: %q", got)
+	}
+
+	if got := render(outputText, "{{.ID}}:{{.Command}}", commands); got != "2:echo \"a,b\"\n1:make\n" {
+		t.Errorf("Unexpected template output: %q", got)
+	}
+	if got := render(outputText, "{{.Total}}", commandStats{Total: 7}); got != "7\n" {
+		t.Errorf("Expected the template to apply to a single result, got %q", got)
+	}
+
+	cmd := &cobra.Command{}
+	cmd.Flags().String("output", "xml", "")
+	cmd.Flags().String("format", "", "")
+	if _, err := rendererFromFlags(cmd); err == nil {
+		t.Error("Expected an unknown output format to be rejected")
+	}
+
+	if got := render(outputCSV, "", contextList{{ID: 3, Timestamp: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), Directory: "/src", Command: "make", Target: true}}); got != "id,timestamp,directory,session,command,target\n3,2026-01-01T00:00:00Z,/src,,make,true\n" {
+		t.Errorf("Unexpected context CSV: %q", got)
+	}
+	if got := render(outputText, "{{len .Failing}}", typoReport{Failing: []failingCommand{{Command: "make"}}}); got != "1\n" {
+		t.Errorf("Unexpected typos template output: %q", got)
+	}
+
+	// Commands that only print text reject the output flags
+	cmd.Flags().Set("output", outputJSON)
+	if err := checkOutputFlags(cmd, nil); err == nil {
+		t.Error("Expected --output to be rejected by a text-only command")
+	}
+	cmd.Annotations = rendersOutput
+	if err := checkOutputFlags(cmd, nil); err != nil {
+		t.Errorf("Expected --output to be accepted by a rendering command, got %v", err)
+	}
+}
+
+func TestCompactListView(t *testing.T) {
+	now := time.Date(2026, 5, 10, 12, 0, 0, 0, time.UTC)
+	failed := 2
+	commands := []Command{
+		{ID: 12, Timestamp: now.Add(-3 * time.Minute), Directory: "/home/me/src/api", Command: "make test", ExitCode: &failed},
+		{ID: 9, Timestamp: now.Add(-50 * time.Hour), Directory: "/home/me", Command: "git clone https://example.com/a/very/long/repository/path.git"},
+	}
+	v := listView{compact: true, columns: strings.Split(defaultListColumns, ","), width: 50, home: "/home/me", now: now}
+
+	lines := v.lines(commands)
+	want := []string{
+		"ID  WHEN    DIRECTORY  COMMAND",
+		"12  3m ago  ~/src/api  make test",
+		"9   2d ago  ~          git clone https://example.…",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Unexpected compact view:\n%s\nwant:\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+	for _, line := range lines {
+		if n := utf8.RuneCountInString(line); n > v.width {
+			t.Errorf("Line exceeds the terminal width (%d): %q", n, line)
+		}
+	}
+
+	// Failed commands are red when color is on
+	v.color = true
+	v.columns = []string{"exit", "command"}
+	lines = v.lines(commands)
+	if !strings.Contains(lines[1], colorRed+"2   "+colorReset) || !strings.Contains(lines[1], colorRed+"make test") {
+		t.Errorf("Expected the failed command in red, got %q", lines[1])
+	}
+	if strings.Contains(lines[2], colorRed) {
+		t.Errorf("Expected no color without an exit code, got %q", lines[2])
+	}
+
+	v.color = false
+	v.columns = []string{"command"}
+	if got := v.cell(Command{Command: "for f in *; do\n\techo $f\ndone"}, "command"); got != "for f in *; do↵ echo $f↵done" {
+		t.Errorf("Expected a multi-line command on one line, got %q", got)
+	}
+
+	if got := relativeTime(now.AddDate(0, -2, 0), now); got != "2026-03-10" {
+		t.Errorf("Expected old times as a date, got %q", got)
+	}
+	if got := abbreviateHome("/home/meow", "/home/me"); got != "/home/meow" {
+		t.Errorf("Expected only the home directory itself to be abbreviated, got %q", got)
+	}
+}
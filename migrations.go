@@ -0,0 +1,348 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migration upgrades the schema by one version. Migrations run in order,
+// each inside its own transaction together with the PRAGMA user_version
+// bump, so a failed upgrade leaves the database at the previous version.
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+// migrations lists every schema change in order. Never edit or reorder a
+// released migration; append a new one instead.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create commands, words and command_word_positions",
+		up: execMigration(`
+		-- Main commands table
+		CREATE TABLE IF NOT EXISTS commands (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			timestamp DATETIME NOT NULL,
+			directory TEXT NOT NULL,
+			full_command TEXT NOT NULL  -- Keep for display purposes
+		);
+		
+		-- Normalized words table to store unique words only once
+		CREATE TABLE IF NOT EXISTS words (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			word TEXT NOT NULL UNIQUE
+		);
+		
+		-- Junction table to link commands to words with position information
+		CREATE TABLE IF NOT EXISTS command_word_positions (
+			command_id INTEGER NOT NULL,
+			word_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,  -- Position of word in command (0-based)
+			PRIMARY KEY (command_id, word_id, position),
+			FOREIGN KEY (command_id) REFERENCES commands(id) ON DELETE CASCADE,
+			FOREIGN KEY (word_id) REFERENCES words(id) ON DELETE CASCADE
+		);
+		
+		CREATE INDEX IF NOT EXISTS idx_timestamp ON commands(timestamp);
+		CREATE INDEX IF NOT EXISTS idx_directory ON commands(directory);
+		CREATE INDEX IF NOT EXISTS idx_full_command ON commands(full_command);
+		CREATE INDEX IF NOT EXISTS idx_words_word ON words(word);
+		CREATE INDEX IF NOT EXISTS idx_command_word_positions_command_id ON command_word_positions(command_id);
+		CREATE INDEX IF NOT EXISTS idx_command_word_positions_word_id ON command_word_positions(word_id);
+		CREATE INDEX IF NOT EXISTS idx_command_word_positions_position ON command_word_positions(position);
+		`),
+	},
+	{
+		version:     2,
+		description: "add exclusion_stats",
+		up: execMigration(`
+		-- Per-rule hit counters for excluded commands (never the command text)
+		CREATE TABLE IF NOT EXISTS exclusion_stats (
+			kind TEXT NOT NULL,
+			rule TEXT NOT NULL,
+			hits INTEGER NOT NULL DEFAULT 0,
+			last_hit DATETIME,
+			PRIMARY KEY (kind, rule)
+		);
+		`),
+	},
+	{
+		version:     3,
+		description: "add stable command UUIDs, hosts and change sequence for sync",
+		up:          migrateSyncColumns,
+	},
+	{
+		version:     4,
+		description: "add settings",
+		up: execMigration(`
+		-- Database-level settings, e.g. the encryption salt and key check value
+		CREATE TABLE IF NOT EXISTS settings (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		);
+		`),
+	},
+	{
+		version:     5,
+		description: "count runs per command",
+		up: execMigration(`
+		-- Deduplication keeps one row per command, so count how often it ran
+		ALTER TABLE commands ADD COLUMN run_count INTEGER NOT NULL DEFAULT 1;
+		`),
+	},
+	{
+		version:     6,
+		description: "add trash",
+		up: execMigration(`
+		-- Commands removed by cleanup, kept as stored (encrypted or not) until
+		-- the undo window has passed
+		CREATE TABLE IF NOT EXISTS trash (
+			id INTEGER PRIMARY KEY,
+			uuid TEXT,
+			host TEXT NOT NULL,
+			timestamp DATETIME NOT NULL,
+			directory TEXT NOT NULL,
+			full_command TEXT NOT NULL,
+			run_count INTEGER NOT NULL,
+			change_seq INTEGER NOT NULL,
+			batch INTEGER NOT NULL,
+			deleted_at DATETIME NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_trash_batch ON trash(batch);
+		`),
+	},
+	{
+		version:     7,
+		description: "add stars, tags and notes",
+		up: execMigration(`
+		CREATE TABLE IF NOT EXISTS stars (
+			command_id INTEGER PRIMARY KEY,
+			starred_at DATETIME NOT NULL,
+			FOREIGN KEY (command_id) REFERENCES commands(id) ON DELETE CASCADE
+		);
+
+		CREATE TABLE IF NOT EXISTS tags (
+			command_id INTEGER NOT NULL,
+			tag TEXT NOT NULL,
+			PRIMARY KEY (command_id, tag),
+			FOREIGN KEY (command_id) REFERENCES commands(id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_tags_tag ON tags(tag);
+
+		CREATE TABLE IF NOT EXISTS notes (
+			command_id INTEGER PRIMARY KEY,
+			note TEXT NOT NULL,
+			updated_at DATETIME NOT NULL,
+			FOREIGN KEY (command_id) REFERENCES commands(id) ON DELETE CASCADE
+		);
+		`),
+	},
+	{
+		version:     8,
+		description: "add snippets",
+		up: execMigration(`
+		-- Parameterized command templates; params holds placeholder defaults as JSON
+		CREATE TABLE IF NOT EXISTS snippets (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			template TEXT NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			params TEXT NOT NULL DEFAULT '{}',
+			created_at DATETIME NOT NULL
+		);
+		`),
+	},
+	{
+		version:     9,
+		description: "keep every run of a command",
+		up: execMigration(`
+		-- commands holds one row per distinct command; runs keeps each time it
+		-- was run, in order, so the surrounding commands can be shown
+		CREATE TABLE IF NOT EXISTS runs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			command_id INTEGER NOT NULL,
+			session TEXT,
+			timestamp DATETIME NOT NULL,
+			directory TEXT NOT NULL,
+			exit_code INTEGER,
+			FOREIGN KEY (command_id) REFERENCES commands(id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_runs_command_id ON runs(command_id);
+		CREATE INDEX IF NOT EXISTS idx_runs_session ON runs(session, id);
+		CREATE INDEX IF NOT EXISTS idx_runs_directory ON runs(directory, id);
+
+		-- Earlier runs were overwritten by deduplication; keep the last one
+		INSERT INTO runs (command_id, timestamp, directory)
+		SELECT id, timestamp, directory FROM commands ORDER BY timestamp, id;
+		`),
+	},
+	{
+		version:     10,
+		description: "add command transitions",
+		up: execMigration(`
+		-- How often next_id followed prev_id in a session, per directory
+		CREATE TABLE IF NOT EXISTS transitions (
+			prev_id INTEGER NOT NULL,
+			next_id INTEGER NOT NULL,
+			directory TEXT NOT NULL,
+			count INTEGER NOT NULL,
+			last_seen DATETIME NOT NULL,
+			PRIMARY KEY (prev_id, next_id, directory),
+			FOREIGN KEY (prev_id) REFERENCES commands(id) ON DELETE CASCADE,
+			FOREIGN KEY (next_id) REFERENCES commands(id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_transitions_next_id ON transitions(next_id);
+		`),
+	},
+	{
+		version:     11,
+		description: "keep annotations of trashed commands",
+		up: execMigration(`
+		-- Stars, tags and notes of commands in the trash, restored with them
+		CREATE TABLE IF NOT EXISTS trash_stars (
+			command_id INTEGER PRIMARY KEY,
+			starred_at DATETIME NOT NULL,
+			FOREIGN KEY (command_id) REFERENCES trash(id) ON DELETE CASCADE
+		);
+
+		CREATE TABLE IF NOT EXISTS trash_tags (
+			command_id INTEGER NOT NULL,
+			tag TEXT NOT NULL,
+			PRIMARY KEY (command_id, tag),
+			FOREIGN KEY (command_id) REFERENCES trash(id) ON DELETE CASCADE
+		);
+
+		CREATE TABLE IF NOT EXISTS trash_notes (
+			command_id INTEGER PRIMARY KEY,
+			note TEXT NOT NULL,
+			updated_at DATETIME NOT NULL,
+			FOREIGN KEY (command_id) REFERENCES trash(id) ON DELETE CASCADE
+		);
+		`),
+	},
+	{
+		version:     12,
+		description: "track shell history numbers of runs",
+		up: execMigration(`
+		-- The shell's history number, so re-sending the same history entry
+		-- (e.g. pressing Enter on an empty line) isn't recorded twice
+		ALTER TABLE runs ADD COLUMN history_id INTEGER;
+		-- Old runs age out with the retention policy
+		CREATE INDEX IF NOT EXISTS idx_runs_timestamp ON runs(timestamp);
+		`),
+	},
+}
+
+// latestSchemaVersion is the version a fully migrated database reports.
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func execMigration(query string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+// migrateDatabase upgrades db to the latest schema version. Databases created
+// before versioning report version 0 and are brought up to date by the same
+// migrations, which only create what is missing.
+func migrateDatabase(db *sql.DB) error {
+	return migrateDatabaseTo(db, latestSchemaVersion())
+}
+
+func migrateDatabaseTo(db *sql.DB, target int) error {
+	current, err := schemaVersion(db)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if current > latestSchemaVersion() {
+		return fmt.Errorf("database schema version %d is newer than this version of %s supports (%d)", current, appName, latestSchemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.version <= current || m.version > target {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.description, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Safe to call even after commit
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	// PRAGMA arguments can't be bound, but the version is our own integer
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", m.version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateSyncColumns(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	ALTER TABLE commands ADD COLUMN uuid TEXT;
+	ALTER TABLE commands ADD COLUMN host TEXT NOT NULL DEFAULT '';
+
+	-- Every local insert or re-run takes the next change_seq, so each sync
+	-- target can keep its own cursor; merged commands keep 0
+	ALTER TABLE commands ADD COLUMN change_seq INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX IF NOT EXISTS idx_commands_change_seq ON commands(change_seq);
+	
+	-- Read position in each other host's changelog
+	CREATE TABLE IF NOT EXISTS sync_state (
+		source TEXT PRIMARY KEY,
+		offset INTEGER NOT NULL
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Existing commands were all recorded on this machine and not synced yet
+	if _, err := tx.Exec("UPDATE commands SET host = ?, change_seq = id", localHostName()); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT id FROM commands")
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if _, err := tx.Exec("UPDATE commands SET uuid = ? WHERE id = ?", newUUID(), id); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_commands_uuid ON commands(uuid)")
+	return err
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Output formats for --output. Text is the human-readable default each
+// command prints itself.
+const (
+	outputText   = "text"
+	outputJSON   = "json"
+	outputNDJSON = "ndjson"
+	outputCSV    = "csv"
+	outputTSV    = "tsv"
+)
+
+var outputFormats = []string{outputText, outputJSON, outputNDJSON, outputCSV, outputTSV}
+
+// tabular is implemented by results that can be written as CSV or TSV.
+type tabular interface {
+	header() []string
+	rows() [][]string
+}
+
+// renderer writes command results in the format chosen with --output, or
+// through the --format template.
+type renderer struct {
+	format string
+	tmpl   *template.Template
+	w      io.Writer
+}
+
+var templateFuncs = template.FuncMap{
+	"join": strings.Join,
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"date": func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+}
+
+// outputAnnotation marks the commands that render their results through
+// renderer. Other commands reject --output and --format.
+const outputAnnotation = "output"
+
+var rendersOutput = map[string]string{outputAnnotation: "true"}
+
+// checkOutputFlags runs before every command, so a command that only prints
+// text fails instead of silently ignoring the output flags.
+func checkOutputFlags(cmd *cobra.Command, _ []string) error {
+	if cmd.Annotations[outputAnnotation] != "" {
+		return nil
+	}
+	format, _ := cmd.Flags().GetString("output")
+	if cmd.Flags().Changed("format") || format != outputText {
+		cmd.SilenceUsage = true
+		return fmt.Errorf("%s does not support --output or --format", cmd.CommandPath())
+	}
+	return nil
+}
+
+// rendererFromFlags reads the global --output and --format flags.
+func rendererFromFlags(cmd *cobra.Command) (*renderer, error) {
+	format, _ := cmd.Flags().GetString("output")
+	tmplText, _ := cmd.Flags().GetString("format")
+
+	r := &renderer{format: format, w: os.Stdout}
+	if tmplText != "" {
+		tmpl, err := template.New("format").Funcs(templateFuncs).Parse(tmplText)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --format template: %w", err)
+		}
+		r.tmpl = tmpl
+		return r, nil
+	}
+	for _, f := range outputFormats {
+		if f == format {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid --output %q: use %s", format, strings.Join(outputFormats, ", "))
+}
+
+// text reports whether the command should print its usual text output.
+func (r *renderer) text() bool {
+	return r.tmpl == nil && r.format == outputText
+}
+
+// render writes v, a struct or a slice of them. Slices become a JSON array,
+// one line per element for NDJSON and templates, and one row per element for
+// CSV and TSV.
+func (r *renderer) render(v interface{}) error {
+	if r.tmpl != nil {
+		for _, item := range elements(v) {
+			if err := r.tmpl.Execute(r.w, item); err != nil {
+				return err
+			}
+			fmt.Fprintln(r.w)
+		}
+		return nil
+	}
+
+	switch r.format {
+	case outputJSON:
+		// An empty result is an empty array rather than null
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice && rv.IsNil() {
+			v = reflect.MakeSlice(rv.Type(), 0, 0).Interface()
+		}
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(r.w, string(data))
+		return err
+	case outputNDJSON:
+		enc := json.NewEncoder(r.w)
+		for _, item := range elements(v) {
+			if err := enc.Encode(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case outputCSV, outputTSV:
+		t, ok := v.(tabular)
+		if !ok {
+			return fmt.Errorf("%s output is not supported here", r.format)
+		}
+		w := csv.NewWriter(r.w)
+		if r.format == outputTSV {
+			w.Comma = '\t'
+		}
+		w.Write(t.header())
+		w.WriteAll(t.rows())
+		return w.Error()
+	}
+	return fmt.Errorf("%s output is not supported here", r.format)
+}
+
+// elements returns the items of a slice, or v itself otherwise.
+func elements(v interface{}) []interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return []interface{}{v}
+	}
+	items := make([]interface{}, rv.Len())
+	for i := range items {
+		items[i] = rv.Index(i).Interface()
+	}
+	return items
+}
+
+// commandList is the result of list and search.
+type commandList []Command
+
+func (l commandList) header() []string {
+	return []string{"id", "timestamp", "directory", "command", "host", "starred", "tags", "note", "exit_code"}
+}
+
+func (l commandList) rows() [][]string {
+	rows := make([][]string, len(l))
+	for i, c := range l {
+		exitCode := ""
+		if c.ExitCode != nil {
+			exitCode = strconv.Itoa(*c.ExitCode)
+		}
+		rows[i] = []string{
+			strconv.Itoa(c.ID), c.Timestamp.Format(time.RFC3339), c.Directory, c.Command,
+			c.Host, strconv.FormatBool(c.Starred), strings.Join(c.Tags, ";"), c.Note, exitCode,
+		}
+	}
+	return rows
+}
+
+// Stats flatten into one row per figure or top-list entry.
+func (s commandStats) header() []string {
+	return []string{"section", "value", "count"}
+}
+
+func (s commandStats) rows() [][]string {
+	rows := [][]string{{"total", "", strconv.Itoa(s.Total)}}
+	if s.Total > 0 {
+		rows = append(rows,
+			[]string{"oldest", s.Oldest.Format(time.RFC3339), ""},
+			[]string{"newest", s.Newest.Format(time.RFC3339), ""},
+		)
+	}
+	for _, section := range []struct {
+		name    string
+		entries []countEntry
+	}{
+		{"directory", s.TopDirectories},
+		{"command", s.TopCommands},
+		{"word", s.TopWords},
+	} {
+		for _, e := range section.entries {
+			rows = append(rows, []string{section.name, e.Value, strconv.Itoa(e.Count)})
+		}
+	}
+	return rows
+}
+
+// Config flattens into one row per setting or rule.
+func (c configReport) header() []string {
+	return []string{"setting", "position", "action", "value"}
+}
+
+func (c configReport) rows() [][]string {
+	rows := [][]string{{"database", "", "", c.Database}}
+	for _, rule := range c.FilterRules {
+		rows = append(rows, []string{"filter_rule", strconv.Itoa(rule.Position), rule.Action, rule.Pattern})
+	}
+	for _, rule := range c.DirectoryRules {
+		rows = append(rows, []string{"directory_rule", strconv.Itoa(rule.Position), rule.Action, rule.Pattern})
+	}
+	if c.IncludeOnly {
+		rows = append(rows, []string{"directory_include_only", "", "", "true"})
+	}
+	if p := c.Retention; p != nil {
+		for _, setting := range []struct {
+			name  string
+			value int
+		}{
+			{"max_age_days", p.MaxAgeDays},
+			{"max_rows", p.MaxRows},
+			{"max_db_size_mb", p.MaxDBSizeMB},
+			{"keep_frequent", p.KeepFrequent},
+			{"check_every", p.CheckEvery},
+		} {
+			if setting.value > 0 {
+				rows = append(rows, []string{"retention." + setting.name, "", "", strconv.Itoa(setting.value)})
+			}
+		}
+		for i, ttl := range p.TTLs {
+			rows = append(rows, []string{"retention.ttl", strconv.Itoa(i + 1), ttl.Pattern, strconv.Itoa(ttl.Days)})
+		}
+	}
+	return rows
+}
+
+// projectList is the result of projects.
+type projectList []projectStats
+
+func (l projectList) header() []string {
+	return []string{"root", "commands", "runs", "directories", "last_active"}
+}
+
+func (l projectList) rows() [][]string {
+	rows := make([][]string, len(l))
+	for i, p := range l {
+		rows[i] = []string{
+			p.Root, strconv.Itoa(p.Commands), strconv.Itoa(p.Runs),
+			strconv.Itoa(p.Directories), p.LastActive.Format(time.RFC3339),
+		}
+	}
+	return rows
+}
+
+// trashList is the result of trash list.
+type trashList []trashEntry
+
+func (l trashList) header() []string {
+	return []string{"batch", "deleted_at", "expires", "id", "command"}
+}
+
+func (l trashList) rows() [][]string {
+	rows := make([][]string, len(l))
+	for i, e := range l {
+		rows[i] = []string{
+			strconv.FormatInt(e.Batch, 10), e.DeletedAt.Format(time.RFC3339),
+			e.Expires.Format(time.RFC3339), strconv.Itoa(e.ID), e.Command,
+		}
+	}
+	return rows
+}
+
+// contextList is the result of context, in the order the runs happened.
+type contextList []contextEntry
+
+func (l contextList) header() []string {
+	return []string{"id", "timestamp", "directory", "session", "command", "target"}
+}
+
+func (l contextList) rows() [][]string {
+	rows := make([][]string, len(l))
+	for i, e := range l {
+		rows[i] = []string{
+			strconv.Itoa(e.ID), e.Timestamp.Format(time.RFC3339), e.Directory,
+			e.Session, e.Command, strconv.FormatBool(e.Target),
+		}
+	}
+	return rows
+}
+
+// snippetList is the result of snippet list.
+type snippetList []Snippet
+
+func (l snippetList) header() []string {
+	return []string{"name", "template", "description"}
+}
+
+func (l snippetList) rows() [][]string {
+	rows := make([][]string, len(l))
+	for i, s := range l {
+		rows[i] = []string{s.Name, s.Template, s.Description}
+	}
+	return rows
+}
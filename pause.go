@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	sessionEnv = "BASHTRACK_SESSION"
+	pausedEnv  = "BASHTRACK_PAUSED"
+	pausedDir  = "paused"
+	allSession = "all"
+)
+
+// currentSession identifies the shell session bashtrack runs in. Both the
+// prompt hook and an interactive "bashtrack pause" are direct children of
+// the shell, so the parent PID is a stable default.
+func currentSession() string {
+	if session := os.Getenv(sessionEnv); session != "" {
+		return session
+	}
+	return strconv.Itoa(os.Getppid())
+}
+
+func pauseFile(session string) (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, pausedDir, session), nil
+}
+
+// isPaused reports whether recording is paused for the current session,
+// either through the environment or a state file.
+func isPaused() bool {
+	if paused, err := strconv.ParseBool(os.Getenv(pausedEnv)); err == nil && paused {
+		return true
+	}
+	for _, session := range []string{allSession, currentSession()} {
+		path, err := pauseFile(session)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// optedOut reports whether the command itself asks not to be recorded, either
+// by a leading space (like HISTCONTROL=ignorespace) or the inline marker.
+func (app *App) optedOut(command string) bool {
+	if app.config.IgnoreSpace && strings.HasPrefix(command, " ") {
+		return true
+	}
+	marker := app.config.OptOutMarker
+	return marker != "" && strings.HasSuffix(strings.TrimSpace(command), marker)
+}
+
+func (app *App) pauseRecording(cmd *cobra.Command, _ []string) {
+	all, _ := cmd.Flags().GetBool("all")
+	session := currentSession()
+	if all {
+		session = allSession
+	}
+
+	path, err := pauseFile(session)
+	if err != nil {
+		ErrorLogger.Printf("Error locating state file: %v\n", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		ErrorLogger.Printf("Error creating state directory: %v\n", err)
+		return
+	}
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		ErrorLogger.Printf("Error pausing recording: %v\n", err)
+		return
+	}
+
+	if all {
+		fmt.Println("Recording paused for all sessions")
+	} else {
+		fmt.Printf("Recording paused for session %s\n", session)
+	}
+}
+
+func (app *App) resumeRecording(cmd *cobra.Command, _ []string) {
+	all, _ := cmd.Flags().GetBool("all")
+
+	if all {
+		configDir, err := getConfigDir()
+		if err != nil {
+			ErrorLogger.Printf("Error locating state directory: %v\n", err)
+			return
+		}
+		if err := os.RemoveAll(filepath.Join(configDir, pausedDir)); err != nil {
+			ErrorLogger.Printf("Error resuming recording: %v\n", err)
+			return
+		}
+		fmt.Println("Recording resumed for all sessions")
+		return
+	}
+
+	session := currentSession()
+	path, err := pauseFile(session)
+	if err != nil {
+		ErrorLogger.Printf("Error locating state file: %v\n", err)
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		ErrorLogger.Printf("Error resuming recording: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Recording resumed for session %s\n", session)
+	if isPaused() {
+		fmt.Println("Note: recording is still paused globally or via " + pausedEnv)
+	}
+}
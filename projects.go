@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// defaultProjectMarkers identify a project root when none are configured.
+var defaultProjectMarkers = []string{".git"}
+
+// ProjectConfig configures how directories are grouped into projects.
+type ProjectConfig struct {
+	// Markers are files or directories whose presence makes a directory a
+	// project root, e.g. go.mod or package.json (default: .git)
+	Markers []string `json:"markers,omitempty"`
+}
+
+// projectStats summarizes the commands run anywhere inside a project.
+type projectStats struct {
+	Root        string       `json:"root"`
+	Commands    int          `json:"commands"`
+	Runs        int          `json:"runs"`
+	Directories int          `json:"directories"`
+	LastActive  time.Time    `json:"last_active"`
+	TopCommands []countEntry `json:"top_commands"`
+}
+
+func (app *App) showProjects(cmd *cobra.Command, _ []string) {
+	n, _ := cmd.Flags().GetInt("number")
+	markers, _ := cmd.Flags().GetStringArray("marker")
+	if len(markers) == 0 {
+		markers = app.config.Projects.Markers
+	}
+	if len(markers) == 0 {
+		markers = defaultProjectMarkers
+	}
+
+	out, err := rendererFromFlags(cmd)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
+
+	projects, err := app.collectProjects(markers, n)
+	if err != nil {
+		ErrorLogger.Printf("Error collecting projects: %v\n", err)
+		return
+	}
+
+	if !out.text() {
+		if err := out.render(projectList(projects)); err != nil {
+			ErrorLogger.Printf("Error writing output: %v\n", err)
+		}
+		return
+	}
+	if len(projects) == 0 {
+		fmt.Printf("No projects found (markers: %s)\n", strings.Join(markers, ", "))
+		return
+	}
+
+	fmt.Printf("Projects (markers: %s):\n", strings.Join(markers, ", "))
+	fmt.Println(strings.Repeat("-", 80))
+	for _, p := range projects {
+		fmt.Printf("%s\n", p.Root)
+		fmt.Printf("  %d runs of %d commands in %d directories, last active %s\n",
+			p.Runs, p.Commands, p.Directories, p.LastActive.Format("2006-01-02 15:04"))
+		for _, e := range p.TopCommands {
+			fmt.Printf("  %6d  %s\n", e.Count, e.Value)
+		}
+	}
+}
+
+// collectProjects groups the recorded runs by the project root of their
+// directory, busiest project first. Directories outside any project, or
+// that no longer exist, are left out. Each project lists its n most run
+// commands.
+func (app *App) collectProjects(markers []string, n int) ([]projectStats, error) {
+	rows, err := app.db.Query(`
+		SELECT r.command_id, r.directory, c.full_command, COUNT(*), MAX(r.timestamp)
+		FROM runs r JOIN commands c ON c.id = r.command_id
+		GROUP BY r.command_id, r.directory`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type project struct {
+		projectStats
+		directories map[string]bool
+		ids         map[int]bool
+		commands    map[string]int
+	}
+	projects := map[string]*project{}
+	roots := map[string]string{}
+	for rows.Next() {
+		var id, runs int
+		var dir, command, lastRunStr string
+		if err := rows.Scan(&id, &dir, &command, &runs, &lastRunStr); err != nil {
+			return nil, err
+		}
+		dir = app.openField(dir)
+
+		root, ok := roots[dir]
+		if !ok {
+			root = projectRoot(dir, markers)
+			roots[dir] = root
+		}
+		if root == "" {
+			continue
+		}
+
+		p, ok := projects[root]
+		if !ok {
+			p = &project{
+				projectStats: projectStats{Root: root},
+				directories:  map[string]bool{},
+				ids:          map[int]bool{},
+				commands:     map[string]int{},
+			}
+			projects[root] = p
+		}
+		p.Runs += runs
+		p.directories[dir] = true
+		p.ids[id] = true
+		p.commands[app.openField(command)] += runs
+		lastRun, err := parseSQLiteTime(lastRunStr)
+		if err != nil {
+			return nil, err
+		}
+		if lastRun.After(p.LastActive) {
+			p.LastActive = lastRun
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]projectStats, 0, len(projects))
+	for _, p := range projects {
+		p.Commands = len(p.ids)
+		p.Directories = len(p.directories)
+		p.TopCommands = topCounts(p.commands, n)
+		result = append(result, p.projectStats)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Runs != result[j].Runs {
+			return result[i].Runs > result[j].Runs
+		}
+		return result[i].Root < result[j].Root
+	})
+	return result, nil
+}
+
+// projectRoot returns the nearest directory at or above dir that contains
+// one of the markers, or "" if there is none.
+func projectRoot(dir string, markers []string) string {
+	if !filepath.IsAbs(dir) {
+		return ""
+	}
+	for {
+		for _, marker := range markers {
+			if _, err := os.Stat(filepath.Join(dir, marker)); err == nil {
+				return dir
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
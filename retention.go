@@ -0,0 +1,408 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetentionCheckEvery = 100
+	defaultTrashDays           = 7
+	// retentionBatch bounds how many commands one automatic check removes
+	retentionBatch = 1000
+)
+
+// RetentionConfig describes which commands are removed automatically. Zero
+// values disable the corresponding limit.
+type RetentionConfig struct {
+	MaxAgeDays  int          `json:"max_age_days,omitempty"`
+	MaxRows     int          `json:"max_rows,omitempty"`
+	MaxDBSizeMB int          `json:"max_db_size_mb,omitempty"`
+	TTLs        []PatternTTL `json:"ttls,omitempty"`
+	// KeepFrequent keeps commands run at least this many times regardless of
+	// the limits above
+	KeepFrequent int `json:"keep_frequent,omitempty"`
+	// CheckEvery applies the policy after every N recorded commands; 0 only
+	// applies it through cleanup --policy
+	CheckEvery int `json:"check_every"`
+	// TrashDays is how long removed commands can be restored
+	TrashDays int `json:"trash_days"`
+}
+
+// PatternTTL overrides MaxAgeDays for commands matching Pattern, e.g. to keep
+// kubectl commands for only 30 days. The first matching pattern wins.
+type PatternTTL struct {
+	Pattern string `json:"pattern"`
+	Days    int    `json:"days"`
+}
+
+func (r RetentionConfig) enabled() bool {
+	return r.MaxAgeDays > 0 || r.MaxRows > 0 || r.MaxDBSizeMB > 0 || len(r.TTLs) > 0
+}
+
+// retentionMatch is a command selected for removal and why.
+type retentionMatch struct {
+	Entry  Command
+	Reason string
+}
+
+type compiledTTL struct {
+	PatternTTL
+	re *regexp.Regexp
+}
+
+// applyRetentionIfDue applies the age and row limits of the retention policy
+// every CheckEvery recorded commands, counted in the settings table. It
+// removes at most retentionBatch commands per check so recording stays fast;
+// TTLs and the size limit need every command decrypted and are left to
+// cleanup --policy.
+func (app *App) applyRetentionIfDue() {
+	policy := app.config.Retention
+	if policy.CheckEvery <= 0 {
+		return
+	}
+
+	var recorded int
+	err := app.db.QueryRow(`
+		INSERT INTO settings (key, value) VALUES ('retention_counter', '1')
+		ON CONFLICT(key) DO UPDATE SET value = CAST(value AS INTEGER) + 1
+		RETURNING value`).Scan(&recorded)
+	if err != nil {
+		ErrorLogger.Printf("Warning: could not check retention: %v\n", err)
+		return
+	}
+	if recorded < policy.CheckEvery {
+		return
+	}
+	if err := setSetting(app.db, "retention_counter", "0"); err != nil {
+		ErrorLogger.Printf("Warning: could not check retention: %v\n", err)
+		return
+	}
+
+	if _, err := app.expireTrash(); err != nil {
+		ErrorLogger.Printf("Warning: could not empty trash: %v\n", err)
+	}
+
+	now := time.Now()
+	if _, err := app.pruneRuns(policy, now, retentionBatch); err != nil {
+		ErrorLogger.Printf("Warning: could not prune runs: %v\n", err)
+	}
+
+	ids, err := app.dueRetentionIDs(policy, now)
+	if err != nil {
+		ErrorLogger.Printf("Warning: could not apply retention policy: %v\n", err)
+		return
+	}
+	if len(ids) == 0 {
+		return
+	}
+	if _, err := app.trashCommands(ids); err != nil {
+		ErrorLogger.Printf("Warning: could not apply retention policy: %v\n", err)
+	}
+}
+
+// dueRetentionIDs selects, oldest first, the commands past MaxAgeDays and
+// beyond MaxRows, up to retentionBatch. A TTL longer than MaxAgeDays raises
+// the age cutoff so nothing the policy would keep is removed.
+func (app *App) dueRetentionIDs(policy RetentionConfig, now time.Time) ([]int, error) {
+	keep := "id NOT IN (SELECT command_id FROM stars)"
+	var keepArgs []interface{}
+	if policy.KeepFrequent > 0 {
+		keep += " AND run_count < ?"
+		keepArgs = append(keepArgs, policy.KeepFrequent)
+	}
+
+	var ids []int
+	if days := policy.maxAgeCutoffDays(); days > 0 {
+		args := append([]interface{}{now.AddDate(0, 0, -days)}, keepArgs...)
+		var err error
+		ids, err = queryIDs(app.db, "SELECT id FROM commands WHERE timestamp < ? AND "+keep+" ORDER BY timestamp, id LIMIT ?",
+			append(args, retentionBatch)...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if policy.MaxRows > 0 {
+		var total int
+		if err := app.db.QueryRow("SELECT COUNT(*) FROM commands").Scan(&total); err != nil {
+			return nil, err
+		}
+		// The expired commands are the oldest, so the row limit's selection
+		// starts with them
+		if excess := total - len(ids) - policy.MaxRows; excess > 0 {
+			var err error
+			ids, err = queryIDs(app.db, "SELECT id FROM commands WHERE "+keep+" ORDER BY timestamp, id LIMIT ?",
+				append(keepArgs, min(len(ids)+excess, retentionBatch))...)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ids, nil
+}
+
+// maxAgeCutoffDays is MaxAgeDays raised to the longest TTL, the age beyond
+// which nothing is kept whatever the command; 0 when there is no age limit.
+func (r RetentionConfig) maxAgeCutoffDays() int {
+	if r.MaxAgeDays <= 0 {
+		return 0
+	}
+	days := r.MaxAgeDays
+	for _, ttl := range r.TTLs {
+		days = max(days, ttl.Days)
+	}
+	return days
+}
+
+// pruneRuns deletes runs older than the age limit, up to limit of them (0 for
+// all), so the run history doesn't grow forever. The latest run of every
+// command is kept for context and exit codes.
+func (app *App) pruneRuns(policy RetentionConfig, now time.Time, limit int) (int64, error) {
+	days := policy.maxAgeCutoffDays()
+	if days <= 0 {
+		return 0, nil
+	}
+	if limit <= 0 {
+		limit = -1 // No limit
+	}
+	result, err := app.db.Exec(`
+		DELETE FROM runs WHERE id IN (
+			SELECT id FROM runs
+			WHERE timestamp < ? AND id NOT IN (SELECT MAX(id) FROM runs GROUP BY command_id)
+			ORDER BY timestamp LIMIT ?)`,
+		now.AddDate(0, 0, -days), limit,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func queryIDs(db *sql.DB, query string, args ...interface{}) ([]int, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// findRetentionMatches returns the commands the policy removes, evaluated at
+// now: expired commands first, then the oldest commands beyond the row and
+// size limits.
+func (app *App) findRetentionMatches(policy RetentionConfig, now time.Time) ([]retentionMatch, error) {
+	ttls := make([]compiledTTL, 0, len(policy.TTLs))
+	for _, ttl := range policy.TTLs {
+		re, err := regexp.Compile(ttl.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention pattern %q: %w", ttl.Pattern, err)
+		}
+		ttls = append(ttls, compiledTTL{ttl, re})
+	}
+
+	rows, err := app.db.Query(`
+		SELECT id, timestamp, full_command, directory, host, run_count,
+		       id IN (SELECT command_id FROM stars)
+		FROM commands ORDER BY timestamp DESC, id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		matches   []retentionMatch
+		remaining []Command // candidates for the row and size limits, newest first
+		total     int
+	)
+	for rows.Next() {
+		var c Command
+		var runCount int
+		if err := rows.Scan(&c.ID, &c.Timestamp, &c.Command, &c.Directory, &c.Host, &runCount, &c.Starred); err != nil {
+			return nil, err
+		}
+		app.openCommand(&c)
+		total++
+
+		// Starred commands are never cleaned up
+		if c.Starred || (policy.KeepFrequent > 0 && runCount >= policy.KeepFrequent) {
+			continue
+		}
+
+		if reason := expiry(c, policy, ttls, now); reason != "" {
+			matches = append(matches, retentionMatch{c, reason})
+			total--
+			continue
+		}
+		remaining = append(remaining, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	excess := 0
+	reason := ""
+	if policy.MaxRows > 0 && total > policy.MaxRows {
+		excess = total - policy.MaxRows
+		reason = fmt.Sprintf("more than %d commands", policy.MaxRows)
+	}
+	if policy.MaxDBSizeMB > 0 && total > 0 {
+		n, err := app.rowsOverSize(int64(policy.MaxDBSizeMB)<<20, total, len(matches))
+		if err != nil {
+			return nil, err
+		}
+		if n > excess {
+			excess = n
+			reason = fmt.Sprintf("database larger than %d MB", policy.MaxDBSizeMB)
+		}
+	}
+	if excess > len(remaining) {
+		excess = len(remaining)
+	}
+	for _, c := range remaining[len(remaining)-excess:] {
+		matches = append(matches, retentionMatch{c, reason})
+	}
+	return matches, nil
+}
+
+// expiry returns why c is past its TTL, or "" if it isn't.
+func expiry(c Command, policy RetentionConfig, ttls []compiledTTL, now time.Time) string {
+	for _, ttl := range ttls {
+		if ttl.re.MatchString(c.Command) {
+			if c.Timestamp.Before(now.AddDate(0, 0, -ttl.Days)) {
+				return fmt.Sprintf("older than %d days (%s)", ttl.Days, ttl.Pattern)
+			}
+			return ""
+		}
+	}
+	if policy.MaxAgeDays > 0 && c.Timestamp.Before(now.AddDate(0, 0, -policy.MaxAgeDays)) {
+		return fmt.Sprintf("older than %d days", policy.MaxAgeDays)
+	}
+	return ""
+}
+
+// rowsOverSize estimates how many more commands must go for the database to
+// fit in maxBytes, assuming every command takes the same share of the file.
+func (app *App) rowsOverSize(maxBytes int64, total, removed int) (int, error) {
+	var pageCount, freePages, pageSize int64
+	if err := app.db.QueryRow("PRAGMA page_count").Scan(&pageCount); err != nil {
+		return 0, err
+	}
+	if err := app.db.QueryRow("PRAGMA freelist_count").Scan(&freePages); err != nil {
+		return 0, err
+	}
+	if err := app.db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return 0, err
+	}
+
+	rows := int64(total + removed)
+	perRow := (pageCount - freePages) * pageSize / rows
+	size := perRow * int64(total)
+	if size <= maxBytes || perRow == 0 {
+		return 0, nil
+	}
+	return int((size - maxBytes + perRow - 1) / perRow), nil
+}
+
+// cleanupSelection narrows cleanup to matching commands. Empty fields match
+// everything.
+type cleanupSelection struct {
+	directory string
+	pattern   *regexp.Regexp
+	host      string
+	before    time.Time
+	after     time.Time
+}
+
+func (s cleanupSelection) empty() bool {
+	return s.directory == "" && s.pattern == nil && s.host == "" && s.before.IsZero() && s.after.IsZero()
+}
+
+func (s cleanupSelection) matches(c Command) bool {
+	if s.directory != "" && !isWithin(c.Directory, s.directory) {
+		return false
+	}
+	if s.pattern != nil && !s.pattern.MatchString(c.Command) {
+		return false
+	}
+	if s.host != "" && c.Host != s.host {
+		return false
+	}
+	if !s.before.IsZero() && !c.Timestamp.Before(s.before) {
+		return false
+	}
+	if !s.after.IsZero() && !c.Timestamp.After(s.after) {
+		return false
+	}
+	return true
+}
+
+// parseTimeFlag accepts a date (2006-01-02), an RFC 3339 timestamp or an age
+// such as 30d or 12h, which counts back from now.
+func parseTimeFlag(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: use a date (2006-01-02), RFC 3339 or an age like 30d", value)
+}
+
+// selectCommands returns every unstarred command matching sel.
+func (app *App) selectCommands(sel cleanupSelection) ([]retentionMatch, error) {
+	rows, err := app.db.Query(`
+		SELECT id, timestamp, full_command, directory, host FROM commands
+		WHERE id NOT IN (SELECT command_id FROM stars)
+		ORDER BY timestamp DESC, id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var matches []retentionMatch
+	for rows.Next() {
+		var c Command
+		if err := rows.Scan(&c.ID, &c.Timestamp, &c.Command, &c.Directory, &c.Host); err != nil {
+			return nil, err
+		}
+		app.openCommand(&c)
+		if sel.matches(c) {
+			matches = append(matches, retentionMatch{c, "selected"})
+		}
+	}
+	return matches, rows.Err()
+}
+
+func retentionIDs(matches []retentionMatch) []int {
+	ids := make([]int, len(matches))
+	for i, m := range matches {
+		ids[i] = m.Entry.ID
+	}
+	return ids
+}
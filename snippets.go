@@ -0,0 +1,483 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// placeholderPattern matches {{name}} placeholders in snippet templates.
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_-]*)\s*\}\}`)
+
+var snippetNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// optionValuePattern matches --name=value options, which become parameters
+// automatically when a snippet is saved.
+var optionValuePattern = regexp.MustCompile(`^--([A-Za-z][A-Za-z0-9_-]*)=(.+)$`)
+
+// Snippet is a reusable command template. Params holds the default value of
+// each placeholder; placeholders without a default must be given on run.
+type Snippet struct {
+	Name        string            `json:"name"`
+	Template    string            `json:"template"`
+	Description string            `json:"description,omitempty"`
+	Params      map[string]string `json:"params,omitempty"`
+}
+
+// snippetFile is the shareable export format.
+type snippetFile struct {
+	Version  int       `json:"version"`
+	Snippets []Snippet `json:"snippets"`
+}
+
+// wordPattern matches the whitespace-separated words of a command.
+var wordPattern = regexp.MustCompile(`\S+`)
+
+// newSnippet turns a command into a template, keeping its spacing and quoting
+// as recorded. The value of every --name=value option becomes a placeholder,
+// as does every whole-word occurrence of an explicit parameter's value.
+func newSnippet(name, command string, params map[string]string) Snippet {
+	s := Snippet{Name: name, Params: map[string]string{}}
+
+	template := wordPattern.ReplaceAllStringFunc(command, func(word string) string {
+		m := optionValuePattern.FindStringSubmatch(word)
+		if m == nil {
+			return word
+		}
+		if _, explicit := params[m[1]]; explicit {
+			return word
+		}
+		s.Params[m[1]] = m[2]
+		return "--" + m[1] + "={{" + m[1] + "}}"
+	})
+
+	// Replace longer values first so a shorter one can't take part of a longer
+	// one's word; words that already hold a placeholder are left alone
+	names := make([]string, 0, len(params))
+	for param := range params {
+		names = append(names, param)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if len(params[names[i]]) != len(params[names[j]]) {
+			return len(params[names[i]]) > len(params[names[j]])
+		}
+		return names[i] < names[j]
+	})
+	for _, param := range names {
+		if value := params[param]; value != "" {
+			template = replaceWholeWords(template, value, "{{"+param+"}}")
+		}
+		s.Params[param] = params[param]
+	}
+
+	s.Template = template
+	return s
+}
+
+// replaceWholeWords replaces the occurrences of value in s that start and end
+// at a word boundary: whitespace, a quote, an option's "=" or a shell
+// operator. Occurrences inside a word containing a placeholder are kept.
+func replaceWholeWords(s, value, replacement string) string {
+	var b strings.Builder
+	i := 0
+	for {
+		j := strings.Index(s[i:], value)
+		if j < 0 {
+			break
+		}
+		start, end := i+j, i+j+len(value)
+		if (start == 0 || isWordBoundary(s[start-1])) && (end == len(s) || isWordBoundary(s[end])) && !inPlaceholderWord(s, start, end) {
+			b.WriteString(s[i:start])
+			b.WriteString(replacement)
+			i = end
+			continue
+		}
+		b.WriteString(s[i : start+1])
+		i = start + 1
+	}
+	b.WriteString(s[i:])
+	return b.String()
+}
+
+func isWordBoundary(c byte) bool {
+	return strings.IndexByte(" \t\n\"'=;|&<>()", c) >= 0
+}
+
+// inPlaceholderWord reports whether the whitespace-separated word around
+// s[start:end] contains a placeholder.
+func inPlaceholderWord(s string, start, end int) bool {
+	wordStart := strings.LastIndexAny(s[:start], " \t\n") + 1
+	wordEnd := len(s)
+	if n := strings.IndexAny(s[end:], " \t\n"); n >= 0 {
+		wordEnd = end + n
+	}
+	return strings.Contains(s[wordStart:wordEnd], "{{")
+}
+
+// placeholders returns the parameter names used in the template, in order of
+// first appearance.
+func (s Snippet) placeholders() []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, m := range placeholderPattern.FindAllStringSubmatch(s.Template, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			names = append(names, m[1])
+		}
+	}
+	return names
+}
+
+// render fills in the placeholders from values, falling back to defaults.
+func (s Snippet) render(values map[string]string) (string, error) {
+	var missing []string
+	for _, name := range s.placeholders() {
+		if _, ok := values[name]; !ok {
+			if _, ok := s.Params[name]; !ok {
+				missing = append(missing, "--"+name)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("snippet %s needs %s", s.Name, strings.Join(missing, ", "))
+	}
+
+	return placeholderPattern.ReplaceAllStringFunc(s.Template, func(placeholder string) string {
+		name := placeholderPattern.FindStringSubmatch(placeholder)[1]
+		if value, ok := values[name]; ok {
+			return value
+		}
+		return s.Params[name]
+	}), nil
+}
+
+func (app *App) saveSnippet(tx execer, s Snippet) error {
+	params, err := json.Marshal(s.Params)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO snippets (name, template, description, params, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET
+			template = excluded.template, description = excluded.description, params = excluded.params`,
+		s.Name, app.sealField(s.Template), app.sealField(s.Description), app.sealField(string(params)), time.Now(),
+	)
+	return err
+}
+
+func (app *App) loadSnippet(name string) (Snippet, error) {
+	s := Snippet{Name: name}
+	var params string
+	err := app.db.QueryRow("SELECT template, description, params FROM snippets WHERE name = ?", name).
+		Scan(&s.Template, &s.Description, &params)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, fmt.Errorf("no snippet named %s", name)
+	}
+	if err != nil {
+		return s, err
+	}
+	return s, app.openSnippet(&s, params)
+}
+
+func (app *App) openSnippet(s *Snippet, params string) error {
+	s.Template = app.openField(s.Template)
+	s.Description = app.openField(s.Description)
+	return json.Unmarshal([]byte(app.openField(params)), &s.Params)
+}
+
+func (app *App) loadSnippets() ([]Snippet, error) {
+	rows, err := app.db.Query("SELECT name, template, description, params FROM snippets ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snippets []Snippet
+	for rows.Next() {
+		var s Snippet
+		var params string
+		if err := rows.Scan(&s.Name, &s.Template, &s.Description, &params); err != nil {
+			return nil, err
+		}
+		if err := app.openSnippet(&s, params); err != nil {
+			return nil, fmt.Errorf("snippet %s: %w", s.Name, err)
+		}
+		snippets = append(snippets, s)
+	}
+	return snippets, rows.Err()
+}
+
+func (app *App) saveSnippetFromCommand(cmd *cobra.Command, args []string) {
+	name, _ := cmd.Flags().GetString("name")
+	description, _ := cmd.Flags().GetString("description")
+	paramFlags, _ := cmd.Flags().GetStringArray("param")
+	overwrite, _ := cmd.Flags().GetBool("overwrite")
+
+	if !snippetNamePattern.MatchString(name) {
+		ErrorLogger.Printf("Invalid snippet name %q; use letters, digits, '-' and '_'\n", name)
+		return
+	}
+
+	if !overwrite {
+		var exists int
+		if err := app.db.QueryRow("SELECT COUNT(*) FROM snippets WHERE name = ?", name).Scan(&exists); err != nil {
+			ErrorLogger.Printf("Error loading snippets: %v\n", err)
+			return
+		}
+		if exists > 0 {
+			ErrorLogger.Printf("Snippet %s already exists; use --overwrite to replace it\n", name)
+			return
+		}
+	}
+
+	id, err := app.parseCommandID(args[0])
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
+	var command string
+	if err := app.db.QueryRow("SELECT full_command FROM commands WHERE id = ?", id).Scan(&command); err != nil {
+		ErrorLogger.Printf("Error loading command: %v\n", err)
+		return
+	}
+
+	params := map[string]string{}
+	for _, p := range paramFlags {
+		key, value, ok := strings.Cut(p, "=")
+		if !ok || key == "" {
+			ErrorLogger.Printf("Invalid --param %q; use name=value\n", p)
+			return
+		}
+		params[key] = value
+	}
+
+	s := newSnippet(name, app.openField(command), params)
+	s.Description = description
+	if err := app.saveSnippet(app.db, s); err != nil {
+		ErrorLogger.Printf("Error saving snippet: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Saved snippet %s:\n", name)
+	printSnippet(s)
+}
+
+func printSnippet(s Snippet) {
+	fmt.Printf("  %s\n", s.Template)
+	if s.Description != "" {
+		fmt.Printf("  %s\n", s.Description)
+	}
+	for _, name := range s.placeholders() {
+		if value, ok := s.Params[name]; ok {
+			fmt.Printf("    --%s (default: %s)\n", name, value)
+		} else {
+			fmt.Printf("    --%s (required)\n", name)
+		}
+	}
+}
+
+func (app *App) listSnippets(cmd *cobra.Command, _ []string) {
+	out, err := rendererFromFlags(cmd)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
+
+	snippets, err := app.loadSnippets()
+	if err != nil {
+		ErrorLogger.Printf("Error loading snippets: %v\n", err)
+		return
+	}
+
+	if !out.text() {
+		if err := out.render(snippetList(snippets)); err != nil {
+			ErrorLogger.Printf("Error writing output: %v\n", err)
+		}
+		return
+	}
+	if len(snippets) == 0 {
+		fmt.Printf("No snippets yet; create one with '%s snippet save <id> --name <name>'\n", appName)
+		return
+	}
+	for _, s := range snippets {
+		fmt.Println(s.Name)
+		printSnippet(s)
+	}
+}
+
+// runSnippet parses its own flags: --exec plus one --name=value (or
+// --name value) per placeholder, which cobra can't declare up front.
+func (app *App) runSnippet(_ *cobra.Command, args []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		ErrorLogger.Println("Usage: snippet run <name> [--param=value...] [--exec]")
+		return
+	}
+
+	s, err := app.loadSnippet(args[0])
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
+
+	execute := false
+	values := map[string]string{}
+	rest := args[1:]
+	for i := 0; i < len(rest); i++ {
+		arg := rest[i]
+		if arg == "--exec" || arg == "-x" {
+			execute = true
+			continue
+		}
+		if !strings.HasPrefix(arg, "--") {
+			ErrorLogger.Printf("Unexpected argument %q\n", arg)
+			return
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+		if !ok {
+			if i+1 >= len(rest) {
+				ErrorLogger.Printf("Missing value for --%s\n", key)
+				return
+			}
+			i++
+			value = rest[i]
+		}
+		values[key] = value
+	}
+
+	command, err := s.render(values)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
+
+	if !execute {
+		fmt.Println(command)
+		return
+	}
+
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	c := exec.Command(shell, "-c", command)
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := c.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitCode())
+		}
+		ErrorLogger.Printf("Error running snippet: %v\n", err)
+	}
+}
+
+func (app *App) deleteSnippet(_ *cobra.Command, args []string) {
+	result, err := app.db.Exec("DELETE FROM snippets WHERE name = ?", args[0])
+	if err != nil {
+		ErrorLogger.Printf("Error deleting snippet: %v\n", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		fmt.Printf("No snippet named %s\n", args[0])
+		return
+	}
+	fmt.Printf("Deleted snippet %s\n", args[0])
+}
+
+func (app *App) exportSnippets(_ *cobra.Command, args []string) {
+	snippets, err := app.loadSnippets()
+	if err != nil {
+		ErrorLogger.Printf("Error loading snippets: %v\n", err)
+		return
+	}
+
+	data, err := json.MarshalIndent(snippetFile{Version: 1, Snippets: snippets}, "", "  ")
+	if err != nil {
+		ErrorLogger.Printf("Error encoding snippets: %v\n", err)
+		return
+	}
+	data = append(data, '\n')
+
+	if len(args) == 0 || args[0] == "-" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := os.WriteFile(args[0], data, 0644); err != nil {
+		ErrorLogger.Printf("Error writing snippets: %v\n", err)
+		return
+	}
+	fmt.Printf("Exported %d snippet(s) to %s\n", len(snippets), args[0])
+}
+
+func (app *App) importSnippets(cmd *cobra.Command, args []string) {
+	overwrite, _ := cmd.Flags().GetBool("overwrite")
+
+	var data []byte
+	var err error
+	if args[0] == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(args[0])
+	}
+	if err != nil {
+		ErrorLogger.Printf("Error reading snippets: %v\n", err)
+		return
+	}
+
+	imported, skipped, err := app.importSnippetData(data, overwrite)
+	if err != nil {
+		ErrorLogger.Printf("Error importing snippets: %v\n", err)
+		return
+	}
+	fmt.Printf("Imported %d snippet(s)", imported)
+	if skipped > 0 {
+		fmt.Printf(", skipped %d existing (use --overwrite to replace them)", skipped)
+	}
+	fmt.Println()
+}
+
+func (app *App) importSnippetData(data []byte, overwrite bool) (int, int, error) {
+	var file snippetFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return 0, 0, fmt.Errorf("invalid snippet file: %w", err)
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback() // Safe to call even after commit
+
+	imported, skipped := 0, 0
+	for _, s := range file.Snippets {
+		if !snippetNamePattern.MatchString(s.Name) || s.Template == "" {
+			return 0, 0, fmt.Errorf("invalid snippet %q: snippets need a valid name and a template", s.Name)
+		}
+		var exists int
+		err := tx.QueryRow("SELECT COUNT(*) FROM snippets WHERE name = ?", s.Name).Scan(&exists)
+		if err != nil {
+			return 0, 0, err
+		}
+		if exists > 0 && !overwrite {
+			skipped++
+			continue
+		}
+		if s.Params == nil {
+			s.Params = map[string]string{}
+		}
+		if err := app.saveSnippet(tx, s); err != nil {
+			return 0, 0, err
+		}
+		imported++
+	}
+	return imported, skipped, tx.Commit()
+}
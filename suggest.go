@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// sameDirectoryWeight boosts transitions seen in the current directory
+	sameDirectoryWeight = 3.0
+	// frequencyWeight scales the fallback score of commands often run in the
+	// current directory, so transitions dominate when there are any
+	frequencyWeight = 0.1
+	// recencyHalfLifeDays halves the weight of history this many days old
+	recencyHalfLifeDays = 30.0
+)
+
+// suggestion is a predicted next command with its score.
+type suggestion struct {
+	CommandID int
+	Command   string
+	Score     float64
+}
+
+func (app *App) suggestCommands(cmd *cobra.Command, _ []string) {
+	n, _ := cmd.Flags().GetInt("number")
+	last, _ := cmd.Flags().GetString("last")
+	dir, _ := cmd.Flags().GetString("dir")
+	verbose, _ := cmd.Flags().GetBool("verbose")
+
+	if dir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			ErrorLogger.Printf("Error getting working directory: %v\n", err)
+			return
+		}
+		dir = wd
+	}
+
+	lastID, err := app.lastCommandID(last)
+	if err != nil {
+		ErrorLogger.Printf("Error finding last command: %v\n", err)
+		return
+	}
+
+	suggestions, err := app.suggestNext(lastID, dir, time.Now(), n)
+	if err != nil {
+		ErrorLogger.Printf("Error computing suggestions: %v\n", err)
+		return
+	}
+
+	// One command per line, so shell widgets can take the first line as is
+	for _, s := range suggestions {
+		if verbose {
+			fmt.Printf("%6.2f  %s\n", s.Score, s.Command)
+		} else {
+			fmt.Println(s.Command)
+		}
+	}
+}
+
+// lastCommandID resolves the command to predict from: the given command text,
+// or else the latest run in the current session. It returns 0 when there is
+// nothing to go on.
+func (app *App) lastCommandID(command string) (int, error) {
+	var id int
+	var err error
+	if command != "" {
+		err = app.db.QueryRow("SELECT id FROM commands WHERE full_command = ?", app.sealField(command)).Scan(&id)
+	} else {
+		err = app.db.QueryRow("SELECT command_id FROM runs WHERE session = ? ORDER BY id DESC LIMIT 1", currentSession()).Scan(&id)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return id, err
+}
+
+// suggestNext scores candidate next commands. Each time a command followed
+// lastID counts, weighted up in dir and down with age; commands frequently
+// run in dir add a smaller score so there is a suggestion even without a
+// matching sequence.
+func (app *App) suggestNext(lastID int, dir string, now time.Time, n int) ([]suggestion, error) {
+	scores := map[int]*suggestion{}
+	add := func(id int, command string, score float64) {
+		s, ok := scores[id]
+		if !ok {
+			s = &suggestion{CommandID: id, Command: app.openField(command)}
+			scores[id] = s
+		}
+		s.Score += score
+	}
+	sealedDir := app.sealField(dir)
+
+	if lastID != 0 {
+		rows, err := app.db.Query(`
+			SELECT t.next_id, c.full_command, t.directory, t.count, t.last_seen
+			FROM transitions t JOIN commands c ON c.id = t.next_id
+			WHERE t.prev_id = ?`, lastID)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id, count int
+			var command, directory string
+			var lastSeen time.Time
+			if err := rows.Scan(&id, &command, &directory, &count, &lastSeen); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			score := float64(count) * recency(lastSeen, now)
+			if directory == sealedDir {
+				score *= sameDirectoryWeight
+			}
+			add(id, command, score)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := app.db.Query(`
+		SELECT r.command_id, c.full_command, COUNT(*), MAX(r.timestamp)
+		FROM runs r JOIN commands c ON c.id = r.command_id
+		WHERE r.directory = ?
+		GROUP BY r.command_id
+		ORDER BY COUNT(*) DESC LIMIT 100`, sealedDir)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, count int
+		var command string
+		var lastRunStr string
+		if err := rows.Scan(&id, &command, &count, &lastRunStr); err != nil {
+			return nil, err
+		}
+		lastRun, err := parseSQLiteTime(lastRunStr)
+		if err != nil {
+			return nil, err
+		}
+		add(id, command, frequencyWeight*float64(count)*recency(lastRun, now))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	delete(scores, lastID) // Repeating the last command is rarely useful
+	suggestions := make([]suggestion, 0, len(scores))
+	for _, s := range scores {
+		suggestions = append(suggestions, *s)
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Score != suggestions[j].Score {
+			return suggestions[i].Score > suggestions[j].Score
+		}
+		return suggestions[i].CommandID > suggestions[j].CommandID
+	})
+	if len(suggestions) > n {
+		suggestions = suggestions[:n]
+	}
+	return suggestions, nil
+}
+
+// recency weighs an observation by its age: 1 for now, 0.5 after
+// recencyHalfLifeDays, and slowly towards 0 after that.
+func recency(t, now time.Time) float64 {
+	if t.IsZero() {
+		return 1
+	}
+	days := now.Sub(t).Hours() / 24
+	if days < 0 {
+		days = 0
+	}
+	return 1 / (1 + days/recencyHalfLifeDays)
+}
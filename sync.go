@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const changelogExt = ".jsonl"
+
+// nextChangeSeq is the SQL expression giving a locally changed command its
+// position in the change sequence that sync targets keep cursors into.
+const nextChangeSeq = "(SELECT COALESCE(MAX(change_seq), 0) + 1 FROM commands)"
+
+// SyncConfig configures history sync between machines, either through a
+// shared directory or a sync server.
+type SyncConfig struct {
+	// Dir is shared between hosts, e.g. through Syncthing, NFS or a git repo
+	Dir string `json:"dir,omitempty"`
+	// Host overrides the host name used for this machine's changelog
+	Host string `json:"host,omitempty"`
+	// Remote is the URL of a bashtrack serve-sync server
+	Remote string `json:"remote,omitempty"`
+	// Token authenticates against Remote; $BASHTRACK_SYNC_TOKEN takes precedence
+	Token string `json:"token,omitempty"`
+	// KeyFile holds the passphrase commands are encrypted with before they are
+	// sent to Remote; $BASHTRACK_SYNC_PASSPHRASE takes precedence
+	KeyFile string `json:"key_file,omitempty"`
+}
+
+// changelogEntry is one line of a host's changelog. Entries are only ever
+// appended; replaying a changelog any number of times gives the same result.
+type changelogEntry struct {
+	Seq       int64     `json:"-"`
+	UUID      string    `json:"uuid"`
+	Host      string    `json:"host"`
+	Timestamp time.Time `json:"timestamp"`
+	Directory string    `json:"directory"`
+	Command   string    `json:"command"`
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func localHostName() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "unknown"
+	}
+	return host
+}
+
+// hostName is the name this machine records commands and writes its
+// changelog under.
+func (app *App) hostName() string {
+	if app.config.Sync.Host != "" {
+		return app.config.Sync.Host
+	}
+	return localHostName()
+}
+
+func changelogName(host string) string {
+	return strings.NewReplacer("/", "_", `\`, "_").Replace(host) + changelogExt
+}
+
+func (app *App) syncHistory(cmd *cobra.Command, _ []string) {
+	dir, _ := cmd.Flags().GetString("dir")
+	remote, _ := cmd.Flags().GetString("remote")
+	if remote == "" && dir == "" {
+		remote = app.config.Sync.Remote
+	}
+	if remote != "" {
+		app.syncRemote(remote)
+		return
+	}
+
+	if dir == "" {
+		dir = app.config.Sync.Dir
+	}
+	if dir == "" {
+		ErrorLogger.Println("No sync target configured; pass --dir or --remote, or set sync.dir or sync.remote in the config")
+		return
+	}
+	dir, err := expandHome(dir)
+	if err != nil {
+		ErrorLogger.Printf("Error resolving sync directory: %v\n", err)
+		return
+	}
+
+	exported, err := app.exportChangelog(dir)
+	if err != nil {
+		ErrorLogger.Printf("Error writing changelog: %v\n", err)
+		return
+	}
+
+	imported, err := app.importChangelogs(dir)
+	if err != nil {
+		ErrorLogger.Printf("Error merging changelogs: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Sync completed:\n")
+	fmt.Printf("  - Appended %d entries to %s\n", exported, changelogName(app.hostName()))
+	fmt.Printf("  - Merged %d entries from other hosts\n", imported)
+}
+
+// exportChangelog appends every command recorded or re-run since the last
+// export to this host's changelog in dir.
+func (app *App) exportChangelog(dir string) (int, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	cursorName := "export:" + dir
+	cursor, err := app.syncCursor(cursorName)
+	if err != nil {
+		return 0, err
+	}
+
+	entries, err := app.changesSince(cursor)
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return 0, err
+		}
+	}
+
+	path := filepath.Join(dir, changelogName(app.hostName()))
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	return len(entries), app.setSyncCursor(app.db, cursorName, entries[len(entries)-1].Seq)
+}
+
+// changesSince returns the commands changed locally after the cursor, in
+// change order.
+func (app *App) changesSince(cursor int64) ([]changelogEntry, error) {
+	rows, err := app.db.Query(`
+		SELECT change_seq, uuid, host, timestamp, directory, full_command
+		FROM commands WHERE change_seq > ? ORDER BY change_seq`, cursor)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []changelogEntry
+	for rows.Next() {
+		var e changelogEntry
+		if err := rows.Scan(&e.Seq, &e.UUID, &e.Host, &e.Timestamp, &e.Directory, &e.Command); err != nil {
+			return nil, err
+		}
+		e.Command = app.openField(e.Command)
+		e.Directory = app.openField(e.Directory)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// syncCursor returns the stored position for a sync source or target.
+func (app *App) syncCursor(name string) (int64, error) {
+	var cursor int64
+	err := app.db.QueryRow("SELECT offset FROM sync_state WHERE source = ?", name).Scan(&cursor)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return cursor, err
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (app *App) setSyncCursor(db execer, name string, cursor int64) error {
+	_, err := db.Exec(`
+		INSERT INTO sync_state (source, offset) VALUES (?, ?)
+		ON CONFLICT(source) DO UPDATE SET offset = excluded.offset`,
+		name, cursor,
+	)
+	return err
+}
+
+// importChangelogs merges the changelogs of all other hosts in dir, resuming
+// each one where the previous sync stopped.
+func (app *App) importChangelogs(dir string) (int, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+changelogExt))
+	if err != nil {
+		return 0, err
+	}
+
+	own := changelogName(app.hostName())
+	total := 0
+	for _, path := range paths {
+		if filepath.Base(path) == own {
+			continue
+		}
+		n, err := app.importChangelog(path)
+		if err != nil {
+			return total, fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (app *App) importChangelog(path string) (int, error) {
+	source := filepath.Base(path)
+
+	offset, err := app.syncCursor(source)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() < offset {
+		// The file was replaced or truncated; merging is idempotent, so
+		// simply start over
+		offset = 0
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // Safe to call even after commit
+
+	merged := 0
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// A trailing partial line is still being written or synced;
+			// pick it up next time
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		offset += int64(len(line))
+
+		var entry changelogEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			ErrorLogger.Printf("Warning: skipping malformed entry in %s: %v\n", source, err)
+			continue
+		}
+		changed, err := app.mergeEntry(tx, entry)
+		if err != nil {
+			return 0, err
+		}
+		if changed {
+			merged++
+		}
+	}
+
+	if err := app.setSyncCursor(tx, source, offset); err != nil {
+		return 0, err
+	}
+	return merged, tx.Commit()
+}
+
+// mergeEntry applies one changelog entry. A command already known by UUID or
+// by its text only has its timestamp moved forward, so replaying an entry
+// changes nothing. Local exclude rules apply to merged commands as well.
+func (app *App) mergeEntry(tx *sql.Tx, e changelogEntry) (bool, error) {
+	words := strings.Fields(e.Command)
+	if e.UUID == "" || len(words) == 0 || app.commandExclusionReason(e.Command, nil) != nil {
+		return false, nil
+	}
+
+	var id int
+	var ts time.Time
+	err := tx.QueryRow("SELECT id, timestamp FROM commands WHERE uuid = ?", e.UUID).Scan(&id, &ts)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = tx.QueryRow("SELECT id, timestamp FROM commands WHERE full_command = ?", app.sealField(e.Command)).Scan(&id, &ts)
+	}
+	if err == nil {
+		if !e.Timestamp.After(ts) {
+			return false, nil
+		}
+		// The merged run counts like one recorded here
+		if _, err := tx.Exec("UPDATE commands SET timestamp = ?, run_count = run_count + 1 WHERE id = ?", e.Timestamp, id); err != nil {
+			return false, err
+		}
+		return true, app.insertRun(tx, int64(id), commandRun{timestamp: e.Timestamp, directory: e.Directory})
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO commands (uuid, host, timestamp, directory, full_command)
+		VALUES (?, ?, ?, ?, ?)`,
+		e.UUID, e.Host, e.Timestamp, app.sealField(e.Directory), app.sealField(e.Command),
+	)
+	if err != nil {
+		return false, err
+	}
+	commandID, err := result.LastInsertId()
+	if err != nil {
+		return false, err
+	}
+	if err := app.insertCommandWords(tx, commandID, words); err != nil {
+		return false, err
+	}
+	// Runs merged from other hosts have no session here
+	return true, app.insertRun(tx, commandID, commandRun{timestamp: e.Timestamp, directory: e.Directory})
+}
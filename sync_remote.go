@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const syncPushBatch = 500
+
+// syncSaltSeparator ends the base64 salt prefixed to every payload, so any
+// client with the passphrase can derive the key it was sealed with.
+const syncSaltSeparator = ":"
+
+// syncPayload is the encrypted part of a remote entry.
+type syncPayload struct {
+	Command   string `json:"command"`
+	Directory string `json:"directory"`
+}
+
+// syncClient pushes and pulls entries to and from a serve-sync server.
+type syncClient struct {
+	baseURL    string
+	token      string
+	host       string
+	passphrase string
+	salt       []byte
+	// keys caches the derived key per salt, since each derivation is slow
+	keys map[string][]byte
+	http *http.Client
+}
+
+func (app *App) newSyncClient(remote string) (*syncClient, error) {
+	token := os.Getenv(syncTokenEnv)
+	if token == "" {
+		token = app.config.Sync.Token
+	}
+	if token == "" {
+		return nil, fmt.Errorf("no sync token; set %s or sync.token in the config", syncTokenEnv)
+	}
+
+	passphrase := os.Getenv(syncPassphraseEnv)
+	if passphrase == "" && app.config.Sync.KeyFile != "" {
+		path, err := expandHome(app.config.Sync.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		passphrase = strings.TrimSpace(string(data))
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("no encryption passphrase; set %s or sync.key_file in the config", syncPassphraseEnv)
+	}
+
+	salt, err := syncSalt(app.db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load sync salt: %w", err)
+	}
+
+	return &syncClient{
+		baseURL:    strings.TrimSuffix(remote, "/"),
+		token:      token,
+		host:       app.hostName(),
+		passphrase: passphrase,
+		salt:       salt,
+		keys:       map[string][]byte{},
+		http:       &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+// syncSalt returns this database's random salt for sync keys, creating it on
+// first use.
+func syncSalt(db *sql.DB) ([]byte, error) {
+	encoded, found, err := getSetting(db, "sync_salt")
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return base64.StdEncoding.DecodeString(encoded)
+	}
+	salt, err := newSalt()
+	if err != nil {
+		return nil, err
+	}
+	if err := setSetting(db, "sync_salt", base64.StdEncoding.EncodeToString(salt)); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// key returns the key derived from the passphrase and salt.
+func (c *syncClient) key(salt []byte) []byte {
+	key, ok := c.keys[string(salt)]
+	if !ok {
+		key = deriveKey(c.passphrase, salt)
+		c.keys[string(salt)] = key
+	}
+	return key
+}
+
+func (c *syncClient) do(method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *syncClient) seal(e changelogEntry) (remoteEntry, error) {
+	data, err := json.Marshal(syncPayload{Command: e.Command, Directory: e.Directory})
+	if err != nil {
+		return remoteEntry{}, err
+	}
+	sealed, err := sealString(c.key(c.salt), string(data))
+	if err != nil {
+		return remoteEntry{}, err
+	}
+	payload := base64.StdEncoding.EncodeToString(c.salt) + syncSaltSeparator + sealed
+	return remoteEntry{UUID: e.UUID, Host: e.Host, Origin: c.host, Timestamp: e.Timestamp, Payload: payload}, nil
+}
+
+func (c *syncClient) open(e remoteEntry) (changelogEntry, error) {
+	encoded, sealed, found := strings.Cut(e.Payload, syncSaltSeparator)
+	if !found {
+		return changelogEntry{}, errors.New("payload has no key salt")
+	}
+	salt, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(salt) == 0 {
+		return changelogEntry{}, errors.New("invalid payload salt")
+	}
+	data, err := openString(c.key(salt), sealed)
+	if err != nil {
+		return changelogEntry{}, err
+	}
+	var payload syncPayload
+	if err := json.Unmarshal([]byte(data), &payload); err != nil {
+		return changelogEntry{}, err
+	}
+	return changelogEntry{
+		UUID:      e.UUID,
+		Host:      e.Host,
+		Timestamp: e.Timestamp,
+		Directory: payload.Directory,
+		Command:   payload.Command,
+	}, nil
+}
+
+func (app *App) syncRemote(remote string) {
+	client, err := app.newSyncClient(remote)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
+
+	pushed, err := app.pushRemote(client)
+	if err != nil {
+		ErrorLogger.Printf("Error pushing to %s: %v\n", remote, err)
+		return
+	}
+
+	pulled, err := app.pullRemote(client)
+	if err != nil {
+		ErrorLogger.Printf("Error pulling from %s: %v\n", remote, err)
+		return
+	}
+
+	fmt.Printf("Sync completed:\n")
+	fmt.Printf("  - Pushed %d entries to %s\n", pushed, remote)
+	fmt.Printf("  - Merged %d entries from other hosts\n", pulled)
+}
+
+// pushRemote sends local changes after the push cursor in batches, moving
+// the cursor after each accepted batch.
+func (app *App) pushRemote(client *syncClient) (int, error) {
+	cursorName := "push:" + client.baseURL
+	cursor, err := app.syncCursor(cursorName)
+	if err != nil {
+		return 0, err
+	}
+
+	entries, err := app.changesSince(cursor)
+	if err != nil {
+		return 0, err
+	}
+
+	pushed := 0
+	for start := 0; start < len(entries); start += syncPushBatch {
+		batch := entries[start:min(start+syncPushBatch, len(entries))]
+
+		page := remotePage{Entries: make([]remoteEntry, 0, len(batch))}
+		for _, e := range batch {
+			sealed, err := client.seal(e)
+			if err != nil {
+				return pushed, err
+			}
+			page.Entries = append(page.Entries, sealed)
+		}
+
+		var result struct {
+			Accepted int `json:"accepted"`
+		}
+		if err := client.do(http.MethodPost, "/v1/entries", page, &result); err != nil {
+			return pushed, err
+		}
+		if err := app.setSyncCursor(app.db, cursorName, batch[len(batch)-1].Seq); err != nil {
+			return pushed, err
+		}
+		pushed += len(batch)
+	}
+	return pushed, nil
+}
+
+// pullRemote merges other hosts' entries after the pull cursor, one page per
+// transaction.
+func (app *App) pullRemote(client *syncClient) (int, error) {
+	cursorName := "pull:" + client.baseURL
+	cursor, err := app.syncCursor(cursorName)
+	if err != nil {
+		return 0, err
+	}
+
+	merged := 0
+	for {
+		query := url.Values{}
+		query.Set("after", strconv.FormatInt(cursor, 10))
+		query.Set("exclude_host", client.host)
+
+		var page remotePage
+		if err := client.do(http.MethodGet, "/v1/entries?"+query.Encode(), nil, &page); err != nil {
+			return merged, err
+		}
+		if page.Cursor <= cursor {
+			return merged, nil
+		}
+
+		n, err := app.mergeRemotePage(client, page)
+		if err != nil {
+			return merged, err
+		}
+		merged += n
+		cursor = page.Cursor
+	}
+}
+
+func (app *App) mergeRemotePage(client *syncClient, page remotePage) (int, error) {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // Safe to call even after commit
+
+	merged := 0
+	for _, remote := range page.Entries {
+		entry, err := client.open(remote)
+		if err != nil {
+			return 0, fmt.Errorf("entry %s: %w", remote.UUID, err)
+		}
+		changed, err := app.mergeEntry(tx, entry)
+		if err != nil {
+			return 0, err
+		}
+		if changed {
+			merged++
+		}
+	}
+
+	if err := app.setSyncCursor(tx, "pull:"+client.baseURL, page.Cursor); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return merged, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	syncTokenEnv      = "BASHTRACK_SYNC_TOKEN"
+	syncPassphraseEnv = "BASHTRACK_SYNC_PASSPHRASE"
+	syncServerDBFile  = "sync-server.db"
+	syncPageLimit     = 1000
+	syncMaxBodyBytes  = 16 << 20
+)
+
+// remoteEntry is a command as stored on the sync server. The command and its
+// directory only travel inside Payload, encrypted by the client, so the
+// server never sees them.
+type remoteEntry struct {
+	Seq       int64     `json:"seq,omitempty"`
+	UUID      string    `json:"uuid"`
+	Host      string    `json:"host"`
+	Origin    string    `json:"origin"` // host that pushed the entry
+	Timestamp time.Time `json:"timestamp"`
+	Payload   string    `json:"payload"`
+}
+
+type remotePage struct {
+	Entries []remoteEntry `json:"entries"`
+	Cursor  int64         `json:"cursor"`
+}
+
+// syncServer is an append-only log of encrypted entries. Clients push their
+// local changes and pull everything after their last cursor.
+type syncServer struct {
+	db    *sql.DB
+	token string
+}
+
+func openSyncServerDatabase(path string) (*sql.DB, error) {
+	connectionString := fmt.Sprintf("%s?cache=shared&mode=rwc&_journal_mode=WAL&_timeout=5000", path)
+	db, err := sql.Open("sqlite3", connectionString)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS entries (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		uuid TEXT NOT NULL,
+		host TEXT NOT NULL,
+		origin TEXT NOT NULL,
+		timestamp DATETIME NOT NULL,
+		payload TEXT NOT NULL,
+		received DATETIME NOT NULL,
+		UNIQUE (uuid, timestamp)
+	);
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create table: %w", err)
+	}
+	return db, nil
+}
+
+func (s *syncServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path != "/v1/entries" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.pullEntries(w, r)
+	case http.MethodPost:
+		s.pushEntries(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *syncServer) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func (s *syncServer) pullEntries(w http.ResponseWriter, r *http.Request) {
+	after, _ := strconv.ParseInt(r.URL.Query().Get("after"), 10, 64)
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > syncPageLimit {
+		limit = syncPageLimit
+	}
+
+	// Read the page and the latest sequence from one snapshot so the cursor
+	// can't skip entries pushed in between
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback() // Read only
+
+	rows, err := tx.Query(`
+		SELECT seq, uuid, host, origin, timestamp, payload FROM entries
+		WHERE seq > ? AND origin != ? ORDER BY seq LIMIT ?`,
+		after, r.URL.Query().Get("exclude_host"), limit,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	page := remotePage{Entries: []remoteEntry{}, Cursor: after}
+	for rows.Next() {
+		var e remoteEntry
+		if err := rows.Scan(&e.Seq, &e.UUID, &e.Host, &e.Origin, &e.Timestamp, &e.Payload); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		page.Entries = append(page.Entries, e)
+		page.Cursor = e.Seq
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Entries pushed by the excluded host are skipped, so also move the cursor
+	// past them when nothing else follows
+	if len(page.Entries) < limit {
+		var last sql.NullInt64
+		if err := tx.QueryRow("SELECT MAX(seq) FROM entries").Scan(&last); err == nil && last.Int64 > page.Cursor {
+			page.Cursor = last.Int64
+		}
+	}
+
+	writeJSON(w, page)
+}
+
+func (s *syncServer) pushEntries(w http.ResponseWriter, r *http.Request) {
+	var page remotePage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, syncMaxBodyBytes)).Decode(&page); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback() // Safe to call even after commit
+
+	now := time.Now()
+	accepted := 0
+	for _, e := range page.Entries {
+		if e.UUID == "" || e.Payload == "" {
+			http.Error(w, "entries need a uuid and payload", http.StatusBadRequest)
+			return
+		}
+		// Retried pushes are ignored thanks to UNIQUE (uuid, timestamp)
+		result, err := tx.Exec(
+			"INSERT OR IGNORE INTO entries (uuid, host, origin, timestamp, payload, received) VALUES (?, ?, ?, ?, ?, ?)",
+			e.UUID, e.Host, e.Origin, e.Timestamp, e.Payload, now,
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			accepted++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]int{"accepted": accepted})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		ErrorLogger.Printf("Error writing response: %v\n", err)
+	}
+}
+
+func (app *App) serveSync(cmd *cobra.Command, _ []string) {
+	addr, _ := cmd.Flags().GetString("addr")
+	dbPath, _ := cmd.Flags().GetString("db")
+	token, _ := cmd.Flags().GetString("token")
+	certFile, _ := cmd.Flags().GetString("tls-cert")
+	keyFile, _ := cmd.Flags().GetString("tls-key")
+
+	if env := os.Getenv(syncTokenEnv); token == "" && env != "" {
+		token = env
+	}
+	if token == "" {
+		ErrorLogger.Printf("A token is required; pass --token or set %s\n", syncTokenEnv)
+		return
+	}
+
+	if dbPath == "" {
+		dbPath = filepath.Join(filepath.Dir(app.config.DatabasePath), syncServerDBFile)
+	}
+	db, err := openSyncServerDatabase(dbPath)
+	if err != nil {
+		ErrorLogger.Printf("Error opening sync database: %v\n", err)
+		return
+	}
+	defer db.Close()
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           &syncServer{db: db, token: token},
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute,
+		WriteTimeout:      time.Minute,
+	}
+
+	InfoLogger.Printf("Serving sync on %s (database %s)\n", addr, dbPath)
+	if certFile != "" || keyFile != "" {
+		err = server.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil {
+		ErrorLogger.Printf("Error serving sync: %v\n", err)
+	}
+}
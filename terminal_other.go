@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package main
+
+import "os"
+
+// terminalWidth is unknown here; callers fall back to $COLUMNS.
+func terminalWidth(_ *os.File) int {
+	return 0
+}
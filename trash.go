@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// trashCommands moves commands to the trash as one batch that can be restored
+// until the undo window has passed. Unlike forget, nothing is scrubbed from
+// disk, so it is not suitable for removing secrets.
+func (app *App) trashCommands(ids []int) (int64, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // Safe to call even after commit
+
+	var batch int64
+	if err := tx.QueryRow("SELECT COALESCE(MAX(batch), 0) + 1 FROM trash").Scan(&batch); err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO trash (id, uuid, host, timestamp, directory, full_command, run_count, change_seq, batch, deleted_at)
+		SELECT id, uuid, host, timestamp, directory, full_command, run_count, change_seq, ?, ?
+		FROM commands WHERE id IN (`+placeholders+`)`,
+		append([]interface{}{batch, time.Now()}, args...)...,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to move commands to trash: %w", err)
+	}
+
+	// Annotations would otherwise cascade away with the commands
+	for _, query := range []string{
+		"INSERT INTO trash_stars (command_id, starred_at) SELECT command_id, starred_at FROM stars",
+		"INSERT INTO trash_tags (command_id, tag) SELECT command_id, tag FROM tags",
+		"INSERT INTO trash_notes (command_id, note, updated_at) SELECT command_id, note, updated_at FROM notes",
+	} {
+		if _, err := tx.Exec(query+" WHERE command_id IN ("+placeholders+")", args...); err != nil {
+			return 0, fmt.Errorf("failed to move annotations to trash: %w", err)
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM command_word_positions WHERE command_id IN ("+placeholders+")", args...); err != nil {
+		return 0, fmt.Errorf("failed to delete word positions: %w", err)
+	}
+	result, err := tx.Exec("DELETE FROM commands WHERE id IN ("+placeholders+")", args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete commands: %w", err)
+	}
+	affected, _ := result.RowsAffected()
+
+	if _, err := tx.Exec("DELETE FROM words WHERE id NOT IN (SELECT word_id FROM command_word_positions)"); err != nil {
+		return 0, fmt.Errorf("failed to delete orphaned words: %w", err)
+	}
+
+	return affected, tx.Commit()
+}
+
+// expireTrash permanently deletes trashed commands older than the undo window.
+func (app *App) expireTrash() (int64, error) {
+	cutoff := time.Now().AddDate(0, 0, -app.config.Retention.TrashDays)
+	result, err := app.db.Exec("DELETE FROM trash WHERE deleted_at < ?", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// restoreTrash moves a batch (or with batch 0, everything) back out of the
+// trash, together with its stars, tags and notes. A command recorded again in
+// the meantime keeps its row and note, and takes over the run count and the
+// remaining annotations of the trashed one.
+func (app *App) restoreTrash(batch int64) (int, error) {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // Safe to call even after commit
+
+	rows, err := tx.Query(`
+		SELECT id, uuid, host, timestamp, directory, full_command, run_count, change_seq
+		FROM trash WHERE ? = 0 OR batch = ? ORDER BY id`, batch, batch)
+	if err != nil {
+		return 0, err
+	}
+	type trashed struct {
+		id                  int64
+		uuid                sql.NullString
+		host                string
+		timestamp           time.Time
+		directory, command  string
+		runCount, changeSeq int64
+	}
+	var entries []trashed
+	for rows.Next() {
+		var e trashed
+		if err := rows.Scan(&e.id, &e.uuid, &e.host, &e.timestamp, &e.directory, &e.command, &e.runCount, &e.changeSeq); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, e := range entries {
+		var existing int64
+		err := tx.QueryRow("SELECT id FROM commands WHERE full_command = ?", e.command).Scan(&existing)
+		switch {
+		case err == nil:
+			_, err = tx.Exec("UPDATE commands SET run_count = run_count + ? WHERE id = ?", e.runCount, existing)
+		case errors.Is(err, sql.ErrNoRows):
+			_, err = tx.Exec(`
+				INSERT INTO commands (id, uuid, host, timestamp, directory, full_command, run_count, change_seq)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				e.id, e.uuid, e.host, e.timestamp, e.directory, e.command, e.runCount, e.changeSeq,
+			)
+			if err == nil {
+				err = app.insertCommandWords(tx, e.id, strings.Fields(app.openField(e.command)))
+			}
+			if err == nil {
+				// Individual runs aren't kept in the trash
+				err = app.insertRun(tx, e.id, commandRun{timestamp: e.timestamp, directory: app.openField(e.directory)})
+			}
+		}
+		if err != nil {
+			return 0, fmt.Errorf("restoring command %d: %w", e.id, err)
+		}
+
+		target := e.id
+		if existing != 0 {
+			target = existing
+		}
+		for _, restore := range []string{
+			"INSERT OR IGNORE INTO stars (command_id, starred_at) SELECT ?, starred_at FROM trash_stars",
+			"INSERT OR IGNORE INTO tags (command_id, tag) SELECT ?, tag FROM trash_tags",
+			"INSERT OR IGNORE INTO notes (command_id, note, updated_at) SELECT ?, note, updated_at FROM trash_notes",
+		} {
+			if _, err := tx.Exec(restore+" WHERE command_id = ?", target, e.id); err != nil {
+				return 0, fmt.Errorf("restoring annotations of command %d: %w", e.id, err)
+			}
+		}
+
+		// The trashed annotations cascade away with the entry
+		if _, err := tx.Exec("DELETE FROM trash WHERE id = ?", e.id); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(entries), tx.Commit()
+}
+
+// trashEntry is a command in the trash, as listed by trash.
+type trashEntry struct {
+	Batch     int64     `json:"batch"`
+	DeletedAt time.Time `json:"deleted_at"`
+	Expires   time.Time `json:"expires"`
+	ID        int       `json:"id"`
+	Command   string    `json:"command"`
+}
+
+func (app *App) listTrash(cmd *cobra.Command, _ []string) {
+	out, err := rendererFromFlags(cmd)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
+
+	rows, err := app.db.Query("SELECT batch, deleted_at, id, full_command FROM trash ORDER BY batch DESC, id")
+	if err != nil {
+		ErrorLogger.Printf("Error reading trash: %v\n", err)
+		return
+	}
+	defer rows.Close()
+
+	var entries trashList
+	for rows.Next() {
+		var e trashEntry
+		var command string
+		if err := rows.Scan(&e.Batch, &e.DeletedAt, &e.ID, &command); err != nil {
+			ErrorLogger.Printf("Error reading trash: %v\n", err)
+			return
+		}
+		e.Expires = e.DeletedAt.AddDate(0, 0, app.config.Retention.TrashDays)
+		e.Command = app.openField(command)
+		entries = append(entries, e)
+	}
+
+	if !out.text() {
+		if err := out.render(entries); err != nil {
+			ErrorLogger.Printf("Error writing output: %v\n", err)
+		}
+		return
+	}
+
+	for i, e := range entries {
+		if i == 0 || e.Batch != entries[i-1].Batch {
+			fmt.Printf("Batch %d, removed %s (restorable until %s):\n",
+				e.Batch, e.DeletedAt.Format("2006-01-02 15:04"), e.Expires.Format("2006-01-02"))
+		}
+		fmt.Printf("  [%d] %s\n", e.ID, e.Command)
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("Trash is empty.")
+	}
+}
+
+func (app *App) restoreFromTrash(cmd *cobra.Command, _ []string) {
+	batch, _ := cmd.Flags().GetInt64("batch")
+	all, _ := cmd.Flags().GetBool("all")
+
+	if !all && batch == 0 {
+		// Undo the most recent cleanup by default
+		if err := app.db.QueryRow("SELECT COALESCE(MAX(batch), 0) FROM trash").Scan(&batch); err != nil {
+			ErrorLogger.Printf("Error reading trash: %v\n", err)
+			return
+		}
+		if batch == 0 {
+			fmt.Println("Trash is empty.")
+			return
+		}
+	}
+
+	restored, err := app.restoreTrash(batch)
+	if err != nil {
+		ErrorLogger.Printf("Error restoring commands: %v\n", err)
+		return
+	}
+	fmt.Printf("Restored %d command(s)\n", restored)
+}
+
+func (app *App) emptyTrash(_ *cobra.Command, _ []string) {
+	result, err := app.db.Exec("DELETE FROM trash")
+	if err != nil {
+		ErrorLogger.Printf("Error emptying trash: %v\n", err)
+		return
+	}
+	removed, _ := result.RowsAffected()
+
+	if err := app.scrubFreePages(); err != nil {
+		ErrorLogger.Printf("Warning: %v\n", err)
+	}
+	fmt.Printf("Permanently removed %d command(s)\n", removed)
+}
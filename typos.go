@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// typo is a failing program name that is probably a misspelt frequent one.
+type typo struct {
+	Word     string `json:"word"`
+	Program  string `json:"program"`
+	Failures int    `json:"failures"`
+	Example  string `json:"example"`
+}
+
+// failingCommand is a command with the runs that failed in one directory.
+type failingCommand struct {
+	Directory string `json:"directory"`
+	Command   string `json:"command"`
+	Failures  int    `json:"failures"`
+	Runs      int    `json:"runs"`
+}
+
+// typoReport is the result of typos.
+type typoReport struct {
+	Typos   []typo           `json:"typos"`
+	Failing []failingCommand `json:"failing"`
+}
+
+func (app *App) showTypos(cmd *cobra.Command, _ []string) {
+	n, _ := cmd.Flags().GetInt("number")
+	minRuns, _ := cmd.Flags().GetInt("min-runs")
+	dir, _ := cmd.Flags().GetString("dir")
+	if dir != "" {
+		expanded, err := expandHome(dir)
+		if err == nil {
+			dir, err = filepath.Abs(expanded)
+		}
+		if err != nil {
+			ErrorLogger.Printf("Error resolving directory: %v\n", err)
+			return
+		}
+	}
+
+	out, err := rendererFromFlags(cmd)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
+
+	typos, err := app.findTypos(minRuns)
+	if err != nil {
+		ErrorLogger.Printf("Error finding typos: %v\n", err)
+		return
+	}
+
+	failing, err := app.failingCommands(dir)
+	if err != nil {
+		ErrorLogger.Printf("Error finding failing commands: %v\n", err)
+		return
+	}
+	// Keep the n most failing commands of each directory
+	shown := []failingCommand{}
+	perDir := 0
+	for i, f := range failing {
+		if i == 0 || f.Directory != failing[i-1].Directory {
+			perDir = 0
+		}
+		if perDir < n {
+			shown = append(shown, f)
+			perDir++
+		}
+	}
+
+	if !out.text() {
+		report := typoReport{Typos: typos, Failing: shown}
+		if report.Typos == nil {
+			report.Typos = []typo{}
+		}
+		if err := out.render(report); err != nil {
+			ErrorLogger.Printf("Error writing output: %v\n", err)
+		}
+		return
+	}
+
+	fmt.Println("Likely typos:")
+	fmt.Println(strings.Repeat("-", 80))
+	if len(typos) == 0 {
+		fmt.Println("  none found")
+	}
+	for _, t := range typos {
+		fmt.Printf("  %-12s -> %-12s %4d failed  e.g. %s\n", t.Word, t.Program, t.Failures, t.Example)
+	}
+
+	fmt.Println()
+	fmt.Println("Most failing commands by directory:")
+	fmt.Println(strings.Repeat("-", 80))
+	if len(shown) == 0 {
+		fmt.Println("  none found (exit codes are recorded by the hook from 'bashtrack setup')")
+	}
+	for i, f := range shown {
+		if i == 0 || f.Directory != shown[i-1].Directory {
+			fmt.Printf("%s\n", f.Directory)
+		}
+		fmt.Printf("  %4d/%-4d failed  %s\n", f.Failures, f.Runs, f.Command)
+	}
+}
+
+// findTypos looks at the program names of failed runs. One that is not itself
+// a frequent program but is within a small edit distance of one run at least
+// minRuns times is likely a typo of it.
+func (app *App) findTypos(minRuns int) ([]typo, error) {
+	rows, err := app.db.Query(`
+		SELECT w.word, SUM(c.run_count)
+		FROM command_word_positions cwp
+		JOIN words w ON w.id = cwp.word_id
+		JOIN commands c ON c.id = cwp.command_id
+		WHERE cwp.position = 0
+		GROUP BY w.word
+		HAVING SUM(c.run_count) >= ?
+		ORDER BY SUM(c.run_count) DESC`, minRuns)
+	if err != nil {
+		return nil, err
+	}
+	var programs []string
+	frequent := map[string]bool{}
+	for rows.Next() {
+		var word string
+		var runs int
+		if err := rows.Scan(&word, &runs); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		word = app.openField(word)
+		programs = append(programs, word)
+		frequent[word] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = app.db.Query(`
+		SELECT w.word, c.full_command, COUNT(*)
+		FROM runs r
+		JOIN commands c ON c.id = r.command_id
+		JOIN command_word_positions cwp ON cwp.command_id = c.id AND cwp.position = 0
+		JOIN words w ON w.id = cwp.word_id
+		WHERE r.exit_code IS NOT NULL AND r.exit_code != 0
+		GROUP BY c.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := map[string]*typo{}
+	for rows.Next() {
+		var word, command string
+		var failures int
+		if err := rows.Scan(&word, &command, &failures); err != nil {
+			return nil, err
+		}
+		word = app.openField(word)
+		if frequent[word] {
+			continue
+		}
+		t, ok := found[word]
+		if !ok {
+			program := closestProgram(word, programs)
+			if program == "" {
+				continue
+			}
+			t = &typo{Word: word, Program: program}
+			found[word] = t
+		}
+		t.Failures += failures
+		if t.Example == "" {
+			t.Example = app.openField(command)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	typos := make([]typo, 0, len(found))
+	for _, t := range found {
+		typos = append(typos, *t)
+	}
+	sort.Slice(typos, func(i, j int) bool {
+		if typos[i].Failures != typos[j].Failures {
+			return typos[i].Failures > typos[j].Failures
+		}
+		return typos[i].Word < typos[j].Word
+	})
+	return typos, nil
+}
+
+// closestProgram returns the most frequent program within typing distance of
+// word: one edit for short names, two for longer ones. programs is ordered
+// by frequency.
+func closestProgram(word string, programs []string) string {
+	maxDistance := 1
+	if len(word) > 5 {
+		maxDistance = 2
+	}
+	best, bestDistance := "", maxDistance+1
+	for _, p := range programs {
+		if d := editDistance(word, p); d < bestDistance {
+			best, bestDistance = p, d
+		}
+	}
+	return best
+}
+
+// editDistance is the optimal string alignment distance: insertions,
+// deletions, substitutions and swaps of adjacent characters each count as one
+// edit, so gti is one edit from git.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(ra)][len(rb)]
+}
+
+// failingCommands returns commands with failed runs, grouped by directory
+// (most failures first) and ordered by failures within each. Only runs with
+// a recorded exit code count. A non-empty dir limits it to that directory.
+func (app *App) failingCommands(dir string) ([]failingCommand, error) {
+	query := `
+		SELECT r.directory, c.full_command,
+			SUM(CASE WHEN r.exit_code != 0 THEN 1 ELSE 0 END), COUNT(*)
+		FROM runs r JOIN commands c ON c.id = r.command_id
+		WHERE r.exit_code IS NOT NULL`
+	var args []interface{}
+	if dir != "" {
+		query += " AND r.directory = ?"
+		args = append(args, app.sealField(dir))
+	}
+	query += `
+		GROUP BY r.directory, r.command_id
+		HAVING SUM(CASE WHEN r.exit_code != 0 THEN 1 ELSE 0 END) > 0`
+
+	rows, err := app.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var failing []failingCommand
+	perDirectory := map[string]int{}
+	for rows.Next() {
+		var f failingCommand
+		if err := rows.Scan(&f.Directory, &f.Command, &f.Failures, &f.Runs); err != nil {
+			return nil, err
+		}
+		f.Directory = app.openField(f.Directory)
+		f.Command = app.openField(f.Command)
+		perDirectory[f.Directory] += f.Failures
+		failing = append(failing, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(failing, func(i, j int) bool {
+		a, b := failing[i], failing[j]
+		if a.Directory != b.Directory {
+			if perDirectory[a.Directory] != perDirectory[b.Directory] {
+				return perDirectory[a.Directory] > perDirectory[b.Directory]
+			}
+			return a.Directory < b.Directory
+		}
+		if a.Failures != b.Failures {
+			return a.Failures > b.Failures
+		}
+		return a.Command < b.Command
+	})
+	return failing, nil
+}